@@ -0,0 +1,321 @@
+package riprovare
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Backoff computes the delays between attempts independently of waiting on
+// them. Each call to Next returns the delay before the next attempt and a
+// boolean indicating if another attempt should be made at all. Reset restores
+// the Backoff to its initial state so it can be used again.
+//
+// Implementations are not required to be safe for concurrent use.
+type Backoff interface {
+	Next() (time.Duration, bool)
+	Reset()
+}
+
+// NewFixedBackoff returns a Backoff that always returns the same delay and never
+// stops. It is typically combined with WithMaxAttemptsBackoff.
+func NewFixedBackoff(delay time.Duration) Backoff {
+	checkDelay(delay)
+	return fixedBackoff{delay: delay}
+}
+
+type fixedBackoff struct {
+	delay time.Duration
+}
+
+func (f fixedBackoff) Next() (time.Duration, bool) {
+	return f.delay, true
+}
+
+func (f fixedBackoff) Reset() {}
+
+// NewExponentialBackoff returns a Backoff that never stops and computes the same
+// delays as ExponentialBackoffRetryPolicy, if maxDelay is greater than zero the
+// delays are capped at maxDelay like those of CappedExponentialBackoffRetryPolicy.
+func NewExponentialBackoff(initialDelay, maxDelay time.Duration, opts ...PolicyOption) Backoff {
+	checkDelay(initialDelay)
+	checkDelay(maxDelay)
+	return newExponentialBackoff(initialDelay, maxDelay, newPolicyConfig(opts))
+}
+
+func newExponentialBackoff(initialDelay, maxDelay time.Duration, cfg policyConfig) *exponentialBackoff {
+	return &exponentialBackoff{initial: initialDelay, max: maxDelay, multiplier: cfg.multiplier, jitter: cfg.jitterStrategy()}
+}
+
+type exponentialBackoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     Jitter
+	retries    int
+}
+
+func (e *exponentialBackoff) Next() (time.Duration, bool) {
+	// Each delay is derived from the initial delay rather than the previous
+	// delay so jitter doesn't compound. The first delay is the initial delay as
+	// is, jitter is applied once the delay has grown.
+	delay := exponentialScaled(e.initial, e.multiplier, e.retries)
+	if e.retries > 0 {
+		delay = e.jitter(delay)
+	}
+	if e.max > 0 && delay > e.max {
+		delay = e.max
+	}
+	e.retries++
+	return delay, true
+}
+
+func (e *exponentialBackoff) Reset() {
+	e.retries = 0
+}
+
+// NewFibonacciBackoff returns a Backoff that never stops and computes the same
+// delays as FibonacciBackoffRetryPolicy.
+func NewFibonacciBackoff(unit time.Duration, opts ...PolicyOption) Backoff {
+	checkDelay(unit)
+	return newFibonacciBackoff(unit, newPolicyConfig(opts))
+}
+
+func newFibonacciBackoff(unit time.Duration, cfg policyConfig) *fibonacciBackoff {
+	return &fibonacciBackoff{unit: unit, jitter: cfg.jitterStrategy()}
+}
+
+type fibonacciBackoff struct {
+	unit    time.Duration
+	jitter  Jitter
+	retries int
+}
+
+func (f *fibonacciBackoff) Next() (time.Duration, bool) {
+	f.retries++
+	return f.jitter(fibonacciBase(f.unit, f.retries)), true
+}
+
+func (f *fibonacciBackoff) Reset() {
+	f.retries = 0
+}
+
+// NewLinearBackoff returns a Backoff that never stops and computes the same
+// delays as LinearRetryPolicy.
+func NewLinearBackoff(initialDelay, increment time.Duration, opts ...PolicyOption) Backoff {
+	checkDelay(initialDelay)
+	checkDelay(increment)
+	return newLinearBackoff(initialDelay, increment, newPolicyConfig(opts))
+}
+
+func newLinearBackoff(initialDelay, increment time.Duration, cfg policyConfig) *linearBackoff {
+	return &linearBackoff{initial: initialDelay, increment: increment, jitter: cfg.jitterStrategy()}
+}
+
+type linearBackoff struct {
+	initial   time.Duration
+	increment time.Duration
+	jitter    Jitter
+	retries   int
+}
+
+func (l *linearBackoff) Next() (time.Duration, bool) {
+	delay := l.jitter(linearBase(l.initial, l.increment, l.retries))
+	l.retries++
+	return delay, true
+}
+
+func (l *linearBackoff) Reset() {
+	l.retries = 0
+}
+
+// scheduleBackoff returns each of its delays once and then stops.
+type scheduleBackoff struct {
+	delays  []time.Duration
+	retries int
+}
+
+func (s *scheduleBackoff) Next() (time.Duration, bool) {
+	if s.retries >= len(s.delays) {
+		return 0, false
+	}
+	s.retries++
+	return s.delays[s.retries-1], true
+}
+
+func (s *scheduleBackoff) Reset() {
+	s.retries = 0
+}
+
+// WithMaxAttemptsBackoff wraps a Backoff so that it stops once max total
+// attempts have been made, regardless of the wrapped Backoff. Like the attempts
+// of the built-in policies, max includes the first attempt, so Next reports true
+// max-1 times.
+func WithMaxAttemptsBackoff(b Backoff, max int) Backoff {
+	checkAttempts(max)
+	return &maxAttemptsBackoff{backoff: b, max: max, attempts: 1}
+}
+
+type maxAttemptsBackoff struct {
+	backoff  Backoff
+	max      int
+	attempts int
+}
+
+func (m *maxAttemptsBackoff) Next() (time.Duration, bool) {
+	if m.attempts >= m.max {
+		return 0, false
+	}
+	m.attempts++
+	return m.backoff.Next()
+}
+
+func (m *maxAttemptsBackoff) Reset() {
+	m.attempts = 1
+	m.backoff.Reset()
+}
+
+// Schedule returns the delays b imposes between attempts if all of the given
+// total attempts fail, without sleeping, which allows previewing a retry
+// configuration. The built-in policies have equivalent Backoffs, for example
+// NewExponentialBackoff computes the delays of ExponentialBackoffRetryPolicy. At
+// most attempts-1 delays are returned, fewer if b stops earlier. b is reset
+// before and after computing the schedule. Disable jitter using WithJitter or
+// seed it using WithRand for a reproducible schedule.
+//
+// Attempts less than 1 will cause a panic.
+func Schedule(b Backoff, attempts int) []time.Duration {
+	checkAttempts(attempts)
+	b.Reset()
+	defer b.Reset()
+	delays := make([]time.Duration, 0, attempts-1)
+	for i := 1; i < attempts; i++ {
+		delay, ok := b.Next()
+		if !ok {
+			break
+		}
+		delays = append(delays, delay)
+	}
+	return delays
+}
+
+// resetDelay restores the initial delay of b. If b limits the attempts using
+// WithMaxAttemptsBackoff only the wrapped Backoff is reset, so the attempts made
+// so far still count.
+func resetDelay(b Backoff) {
+	if m, ok := b.(*maxAttemptsBackoff); ok {
+		m.backoff.Reset()
+		return
+	}
+	b.Reset()
+}
+
+// DecorrelatedJitterBackoff is a Backoff implementing the "decorrelated jitter"
+// algorithm, where each delay is a random duration between Base and three times
+// the previous delay, capped at Cap. Compared to exponential backoff with jitter
+// it spreads retries of many clients failing at the same time more evenly.
+//
+// The zero value is ready to use once Base and Cap are set. Next and Reset are
+// safe for concurrent use, although sharing a DecorrelatedJitterBackoff between
+// operations means they share the previous delay as well.
+type DecorrelatedJitterBackoff struct {
+	Base time.Duration
+	Cap  time.Duration
+
+	mu   sync.Mutex
+	prev time.Duration
+}
+
+// Next returns min(Cap, random(Base, previous*3)). A Cap less than Base is
+// treated as Base, so the delays never drop below Base. It never stops.
+func (d *DecorrelatedJitterBackoff) Next() (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.prev < d.Base {
+		d.prev = d.Base
+	}
+	delay := d.Base
+	if upper := d.prev * 3; upper > d.Base {
+		delay += time.Duration(defaultRand.Int63n(int64(upper - d.Base)))
+	}
+	if limit := d.Cap; delay > limit {
+		if limit < d.Base {
+			limit = d.Base
+		}
+		delay = limit
+	}
+	d.prev = delay
+	return delay, true
+}
+
+// Reset restores the previous delay to Base.
+func (d *DecorrelatedJitterBackoff) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prev = d.Base
+}
+
+// BackoffRetryPolicy is a RetryPolicy that retries for as long as the Backoff
+// allows it, waiting the delay returned by the Backoff between attempts. Retry
+// waits the delays itself, so they are interrupted once the context configured
+// using WithContext is done, capped by WithMaxDelay, adjusted by
+// WithDelayInterceptor and reported to OnRetry and WithLogger. Invoked directly
+// the policy sleeps the delay before returning. The Backoff is reset when Retry
+// consults the policy for the first time during an operation.
+func BackoffRetryPolicy(b Backoff) RetryPolicy {
+	return builtinPolicy(func(c *consultation) bool {
+		if c.reset {
+			b.Reset()
+		} else if c.resetDelay {
+			resetDelay(b)
+		}
+		// If the error is from the context being canceled or its deadline
+		// passing there is no reason to continue retrying
+		if contextDone(c.err) {
+			return false
+		}
+		delay, ok := b.Next()
+		if !ok {
+			return false
+		}
+		c.delay = delay
+		return true
+	})
+}
+
+// RetryBackoff invokes fn and retries for as long as the Backoff allows it, a
+// shorthand for Retry with BackoffRetryPolicy. As with any RetryPolicy, a delay
+// configured using WithDelayFunc adds to the delays of the Backoff, and a delay
+// requested by an error implementing RetryAfterCarrier is waited instead. The
+// Backoff is reset once the first attempt failed.
+//
+// A nil Backoff or Retryable will cause a panic.
+func RetryBackoff(b Backoff, fn Retryable, opts ...Option) error {
+	if b == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil Backoff"))
+	}
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	_, err := retryN(BackoffRetryPolicy(b), fn, nil, opts)
+	return err
+}
+
+// DecorrelatedJitterRetryPolicy is a RetryPolicy that retries the max attempts,
+// waiting a delay computed by a DecorrelatedJitterBackoff with the provided
+// base and maximum delay between attempts. Each delay is a random duration
+// between base and three times the previous delay, capped at maxDelay.
+//
+// A base of zero or less or a maxDelay less than base will cause a panic.
+func DecorrelatedJitterRetryPolicy(attempts int, base, maxDelay time.Duration) RetryPolicy {
+	checkAttempts(attempts)
+	// A zero base would make every delay zero, as each one is based on the last
+	if base <= 0 {
+		panic(fmt.Errorf("illegal use of api: base delay must be greater than zero"))
+	}
+	if maxDelay < base {
+		panic(fmt.Errorf("illegal use of api: max delay must not be less than the base delay"))
+	}
+	return BackoffRetryPolicy(WithMaxAttemptsBackoff(&DecorrelatedJitterBackoff{Base: base, Cap: maxDelay}, attempts))
+}
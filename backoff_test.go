@@ -0,0 +1,239 @@
+package riprovare
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithMaxAttemptsBackoff(t *testing.T) {
+	b := WithMaxAttemptsBackoff(NewFixedBackoff(10*time.Millisecond), 3)
+
+	for i := 0; i < 2; i++ {
+		delay, ok := b.Next()
+		assert.True(t, ok)
+		assert.Equal(t, 10*time.Millisecond, delay)
+	}
+	_, ok := b.Next()
+	assert.False(t, ok)
+
+	b.Reset()
+	_, ok = b.Next()
+	assert.True(t, ok)
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := NewExponentialBackoff(100*time.Millisecond, time.Second, WithRand(rand.New(rand.NewSource(1))))
+	var delays []time.Duration
+	for i := 0; i < 6; i++ {
+		delay, ok := b.Next()
+		assert.True(t, ok)
+		delays = append(delays, delay)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	expected := []time.Duration{100 * time.Millisecond}
+	for _, d := range []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond} {
+		expected = append(expected, time.Duration(float64(d)*(0.75+r.Float64()*0.5)))
+	}
+	// 1.6s and 3.2s remain above the cap of 1s regardless of the jitter
+	expected = append(expected, time.Second, time.Second)
+	assert.Equal(t, expected, delays)
+
+	b.Reset()
+	delay, _ := b.Next()
+	assert.Equal(t, 100*time.Millisecond, delay)
+}
+
+func TestSchedule(t *testing.T) {
+	b := NewExponentialBackoff(time.Second, 0, WithJitter(false))
+	delays := Schedule(b, 5)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}, delays)
+
+	var total time.Duration
+	for _, d := range delays {
+		total += d
+	}
+	assert.Equal(t, 15*time.Second, total)
+
+	// The schedule ends when the Backoff stops
+	assert.Len(t, Schedule(WithMaxAttemptsBackoff(NewFixedBackoff(time.Second), 3), 10), 2)
+	assert.Empty(t, Schedule(NewFixedBackoff(time.Second), 1))
+
+	// The Backoff is reset afterwards
+	delay, _ := b.Next()
+	assert.Equal(t, time.Second, delay)
+
+	assert.Panics(t, func() {
+		Schedule(b, 0)
+	})
+}
+
+func TestLinearBackoff(t *testing.T) {
+	b := NewLinearBackoff(10*time.Millisecond, 5*time.Millisecond, WithJitter(false))
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 15 * time.Millisecond, 20 * time.Millisecond}, Schedule(b, 4))
+}
+
+func TestFibonacciBackoff(t *testing.T) {
+	b := NewFibonacciBackoff(10 * time.Millisecond)
+	for _, fib := range []time.Duration{1, 1, 2, 3, 5, 8} {
+		delay, ok := b.Next()
+		assert.True(t, ok)
+		assert.GreaterOrEqual(t, delay, time.Duration(float64(fib*10*time.Millisecond)*0.75))
+		assert.LessOrEqual(t, delay, time.Duration(float64(fib*10*time.Millisecond)*1.25))
+	}
+
+	b.Reset()
+	delay, _ := b.Next()
+	assert.LessOrEqual(t, delay, time.Duration(float64(10*time.Millisecond)*1.25))
+}
+
+func TestBackoffRetryPolicy(t *testing.T) {
+	counter := 0
+	start := time.Now()
+	err := Retry(BackoffRetryPolicy(WithMaxAttemptsBackoff(NewFixedBackoff(50*time.Millisecond), 3)), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 3, counter)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestBackoffRetryPolicy_Reused(t *testing.T) {
+	policy := BackoffRetryPolicy(WithMaxAttemptsBackoff(NewFixedBackoff(time.Millisecond), 3))
+	for i := 0; i < 2; i++ {
+		counter := 0
+		err := Retry(policy, func() error {
+			counter++
+			return fmt.Errorf("oh snap this broke")
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 3, counter)
+	}
+}
+
+func TestBackoffRetryPolicy_ContextCanceled(t *testing.T) {
+	policy := BackoffRetryPolicy(NewFixedBackoff(time.Second))
+	assert.False(t, policy(context.Canceled))
+}
+
+func TestDecorrelatedJitterBackoff(t *testing.T) {
+	b := &DecorrelatedJitterBackoff{Base: 10 * time.Millisecond, Cap: time.Second}
+
+	prev := b.Base
+	reachedCap := false
+	for i := 0; i < 100; i++ {
+		delay, ok := b.Next()
+		assert.True(t, ok)
+		assert.GreaterOrEqual(t, delay, b.Base)
+		assert.LessOrEqual(t, delay, b.Cap)
+		if prev*3 < b.Cap {
+			assert.Less(t, delay, prev*3)
+		}
+		if delay == b.Cap {
+			reachedCap = true
+		}
+		prev = delay
+	}
+	assert.True(t, reachedCap)
+}
+
+func TestDecorrelatedJitterBackoff_CapBelowBase(t *testing.T) {
+	b := &DecorrelatedJitterBackoff{Base: 10 * time.Millisecond, Cap: 5 * time.Millisecond}
+	for i := 0; i < 20; i++ {
+		delay, ok := b.Next()
+		assert.True(t, ok)
+		assert.Equal(t, b.Base, delay)
+	}
+}
+
+func TestDecorrelatedJitterBackoff_Reset(t *testing.T) {
+	b := &DecorrelatedJitterBackoff{Base: 10 * time.Millisecond, Cap: time.Hour}
+	for i := 0; i < 20; i++ {
+		b.Next()
+	}
+
+	b.Reset()
+	delay, _ := b.Next()
+	assert.GreaterOrEqual(t, delay, 10*time.Millisecond)
+	assert.Less(t, delay, 30*time.Millisecond)
+}
+
+func TestDecorrelatedJitterRetryPolicy(t *testing.T) {
+	base, maxDelay := 5*time.Millisecond, 20*time.Millisecond
+	policy := DecorrelatedJitterRetryPolicy(6, base, maxDelay)
+
+	var delays []time.Duration
+	for {
+		start := time.Now()
+		if !policy(fmt.Errorf("oh snap this broke")) {
+			break
+		}
+		delays = append(delays, time.Since(start))
+	}
+
+	assert.Len(t, delays, 5)
+	for _, d := range delays {
+		assert.GreaterOrEqual(t, d, base)
+		assert.Less(t, d, maxDelay+15*time.Millisecond)
+	}
+}
+
+func TestDecorrelatedJitterRetryPolicy_ContextCanceled(t *testing.T) {
+	policy := DecorrelatedJitterRetryPolicy(3, time.Second, time.Minute)
+	assert.False(t, policy(context.Canceled))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var delays []time.Duration
+	counter := 0
+	err := RetryBackoff(WithMaxAttemptsBackoff(NewExponentialBackoff(time.Millisecond, 0, WithJitter(false)), 4), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, OnRetry(func(attempt int, err error, nextDelay time.Duration) {
+		delays = append(delays, nextDelay)
+	}), WithMaxDelay(3*time.Millisecond))
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 4, counter)
+	// Retry waits the delays itself, so they are observed and capped
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond}, delays)
+}
+
+func TestRetryBackoff_WithDelayFunc(t *testing.T) {
+	var delays []time.Duration
+	err := RetryBackoff(WithMaxAttemptsBackoff(NewFixedBackoff(time.Millisecond), 3), func() error {
+		return fmt.Errorf("oh snap this broke")
+	}, WithDelayFunc(func(attempt int, err error) time.Duration {
+		return time.Duration(attempt) * time.Millisecond
+	}), OnRetry(func(attempt int, err error, nextDelay time.Duration) {
+		delays = append(delays, nextDelay)
+	}))
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	// The DelayFunc adds to the delays of the Backoff
+	assert.Equal(t, []time.Duration{2 * time.Millisecond, 3 * time.Millisecond}, delays)
+}
+
+func TestRetryBackoff_ContextDone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	b := NewFixedBackoff(time.Hour)
+	counter := 0
+	start := time.Now()
+	err := RetryBackoff(b, func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithContext(ctx))
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, counter)
+	assert.Less(t, time.Since(start), time.Second)
+}
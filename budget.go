@@ -0,0 +1,100 @@
+package riprovare
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RetryBudget limits how many retries may be made across all operations sharing
+// it, which keeps uncoordinated retries of many goroutines from amplifying the
+// load on a dependency that is already failing. It is a token bucket holding up
+// to max tokens, every retry consumes a token and a token is added back every
+// refill interval. Once the budget is exhausted Retry stops retrying until
+// tokens have been refilled.
+//
+// A RetryBudget is safe for concurrent use and is meant to be created once and
+// shared using WithBudget.
+type RetryBudget struct {
+	mu     sync.Mutex
+	max    int
+	refill time.Duration
+	tokens int
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewRetryBudget returns a full RetryBudget holding up to max tokens, adding a
+// token every refill interval.
+//
+// A max less than 1 or a refill interval of zero or less will cause a panic.
+func NewRetryBudget(max int, refill time.Duration) *RetryBudget {
+	if max < 1 {
+		panic(fmt.Errorf("illegal use of api: retry budget must hold at least 1 token"))
+	}
+	if refill <= 0 {
+		panic(fmt.Errorf("illegal use of api: refill interval must be greater than zero"))
+	}
+	return &RetryBudget{max: max, refill: refill, tokens: max, last: time.Now(), now: time.Now}
+}
+
+// Available returns the number of retries the budget currently allows.
+func (b *RetryBudget) Available() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillTokens()
+	return b.tokens
+}
+
+// withdraw consumes a token if one is available.
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillTokens()
+	if b.tokens == 0 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// deposit returns a token that was withdrawn but not used.
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < b.max {
+		b.tokens++
+	}
+}
+
+// refillTokens adds the tokens accumulated since the last refill. b.mu must be
+// held.
+func (b *RetryBudget) refillTokens() {
+	now := b.now()
+	n := int(now.Sub(b.last) / b.refill)
+	if n <= 0 {
+		return
+	}
+	b.last = b.last.Add(time.Duration(n) * b.refill)
+	if b.tokens += n; b.tokens >= b.max || b.tokens < 0 {
+		b.tokens = b.max
+		b.last = now
+	}
+}
+
+// WithBudget makes every retry consume a token of b, which is typically shared
+// by many operations. If the budget is exhausted Retry stops retrying and
+// returns an UnrecoverableError wrapping the error of the last attempt, without
+// consulting the RetryPolicy. The token is returned if the attempt is not
+// retried after all, because the RetryPolicy declines or the delay would end
+// past the deadline or the maximum elapsed time.
+//
+// A nil RetryBudget will cause a panic.
+func WithBudget(b *RetryBudget) Option {
+	if b == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil RetryBudget"))
+	}
+	return func(r *retry) {
+		r.budget = b
+	}
+}
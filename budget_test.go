@@ -0,0 +1,120 @@
+package riprovare
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Now()
+	b := NewRetryBudget(3, time.Second)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.withdraw())
+	}
+	assert.False(t, b.withdraw())
+	assert.Equal(t, 0, b.Available())
+
+	now = now.Add(2500 * time.Millisecond)
+	assert.Equal(t, 2, b.Available())
+
+	// Refills never exceed the capacity
+	now = now.Add(time.Hour)
+	assert.Equal(t, 3, b.Available())
+
+	assert.Panics(t, func() {
+		NewRetryBudget(0, time.Second)
+	})
+	assert.Panics(t, func() {
+		NewRetryBudget(1, 0)
+	})
+}
+
+func TestRetry_WithBudget(t *testing.T) {
+	b := NewRetryBudget(3, time.Hour)
+
+	counter := 0
+	err := Retry(SimpleRetryPolicy(10), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithBudget(b))
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 4, counter)
+	assert.Equal(t, 0, b.Available())
+
+	// The exhausted budget is shared, so other operations no longer retry
+	counter = 0
+	err = Retry(SimpleRetryPolicy(10), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithBudget(b))
+	assert.Error(t, err)
+	assert.Equal(t, 1, counter)
+}
+
+func TestRetry_WithBudgetPolicyDeclines(t *testing.T) {
+	b := NewRetryBudget(5, time.Hour)
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		return fmt.Errorf("oh snap this broke")
+	}, WithBudget(b))
+
+	// Only the two retries consume tokens
+	assert.Error(t, err)
+	assert.Equal(t, 3, b.Available())
+}
+
+func TestRetry_WithBudgetTimeLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{name: "max elapsed time", opt: WithMaxElapsedTime(time.Second)},
+		{name: "deadline", opt: WithDeadline(time.Now().Add(time.Minute))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewRetryBudget(3, time.Hour)
+			counter := 0
+			err := Retry(FixedRetryPolicy(5, time.Hour), func() error {
+				counter++
+				return fmt.Errorf("oh snap this broke")
+			}, WithBudget(b), tt.opt)
+
+			// The delay ends past the time limit, so no token is spent
+			assert.ErrorAs(t, err, &UnrecoverableError{})
+			assert.Equal(t, 1, counter)
+			assert.Equal(t, 3, b.Available())
+		})
+	}
+}
+
+func TestRetry_WithBudgetConcurrent(t *testing.T) {
+	b := NewRetryBudget(50, time.Hour)
+
+	var mu sync.Mutex
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = Retry(SimpleRetryPolicy(10), func() error {
+				mu.Lock()
+				counter++
+				mu.Unlock()
+				return fmt.Errorf("oh snap this broke")
+			}, WithBudget(b))
+		}()
+	}
+	wg.Wait()
+
+	// Every operation makes its first attempt, only 50 retries are allowed
+	assert.Equal(t, 70, counter)
+	assert.Equal(t, 0, b.Available())
+}
@@ -0,0 +1,107 @@
+package riprovare
+
+import (
+	"fmt"
+	"time"
+)
+
+// And returns a RetryPolicy that continues retrying only if all policies agree.
+//
+// Every policy is invoked exactly once for each decision, in the order provided,
+// even once one of them has declined, so policies that keep track of attempts
+// stay in step and are reset together. If all of them agree
+// to retry, their delays add up. Combining a single policy with delays, such as
+// ExponentialBackoffRetryPolicy, with policies without delays, such as
+// SimpleRetryPolicy or predicates inspecting the error, yields exactly the
+// delays of the former.
+//
+// A nil RetryPolicy will cause a panic.
+func And(policies ...RetryPolicy) RetryPolicy {
+	checkPolicies(policies)
+	return builtinPolicy(func(c *consultation) bool {
+		retry := true
+		for _, policy := range policies {
+			inner := consultation{err: c.err, reset: c.reset, resetDelay: c.resetDelay}
+			if policy(&inner) {
+				c.delay = addDelay(c.delay, inner.delay)
+			} else {
+				retry = false
+			}
+		}
+		return retry
+	})
+}
+
+// Or returns a RetryPolicy that continues retrying if any of the policies agrees.
+// Without policies it never retries.
+//
+// Like And, every policy is invoked exactly once for each decision, in the order
+// provided, even once one of them has agreed, and the delays of all agreeing
+// policies add up.
+//
+// A nil RetryPolicy will cause a panic.
+func Or(policies ...RetryPolicy) RetryPolicy {
+	checkPolicies(policies)
+	return builtinPolicy(func(c *consultation) bool {
+		retry := false
+		for _, policy := range policies {
+			inner := consultation{err: c.err, reset: c.reset, resetDelay: c.resetDelay}
+			if policy(&inner) {
+				c.delay = addDelay(c.delay, inner.delay)
+				retry = true
+			}
+		}
+		return retry
+	})
+}
+
+// Limit returns a RetryPolicy that follows policy but never allows more than n
+// total attempts, counting the first attempt. Once the limit is reached policy
+// is no longer consulted.
+//
+// A nil RetryPolicy or a n less than 1 will cause a panic.
+func Limit(n int, policy RetryPolicy) RetryPolicy {
+	checkAttempts(n)
+	checkPolicies([]RetryPolicy{policy})
+	attempts := 1
+	return builtinPolicy(func(c *consultation) bool {
+		if c.reset {
+			attempts = 1
+		}
+		if attempts >= n {
+			return false
+		}
+		attempts++
+		return policy(c)
+	})
+}
+
+// MaxDuration returns a RetryPolicy that follows policy until d has passed since
+// it was first consulted, which is when the first attempt failed. Once d has
+// passed policy is no longer consulted. Retry itself can limit the time spent
+// retrying using WithMaxElapsedTime, which also accounts for the first attempt.
+//
+// A nil RetryPolicy will cause a panic.
+func MaxDuration(d time.Duration, policy RetryPolicy) RetryPolicy {
+	checkPolicies([]RetryPolicy{policy})
+	var start time.Time
+	return builtinPolicy(func(c *consultation) bool {
+		if c.reset {
+			start = time.Time{}
+		}
+		if start.IsZero() {
+			start = time.Now()
+		} else if time.Since(start) >= d {
+			return false
+		}
+		return policy(c)
+	})
+}
+
+func checkPolicies(policies []RetryPolicy) {
+	for _, policy := range policies {
+		if policy == nil {
+			panic(fmt.Errorf("illegal use of api: cannot operate on nil RetryPolicy"))
+		}
+	}
+}
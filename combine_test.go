@@ -0,0 +1,145 @@
+package riprovare
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnd(t *testing.T) {
+	counter := 0
+	err := Retry(And(SimpleRetryPolicy(5), SimpleRetryPolicy(3)), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 3, counter)
+}
+
+func TestAnd_Predicate(t *testing.T) {
+	transient := errors.New("transient")
+	counter := 0
+	err := Retry(And(SimpleRetryPolicy(5), func(err error) bool {
+		return errors.Is(err, transient)
+	}), func() error {
+		counter++
+		if counter == 2 {
+			return errors.New("fatal")
+		}
+		return transient
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 2, counter)
+}
+
+func TestOr(t *testing.T) {
+	counter := 0
+	err := Retry(Or(SimpleRetryPolicy(2), SimpleRetryPolicy(4)), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 4, counter)
+	assert.False(t, Or()(errors.New("oh snap this broke")))
+}
+
+func TestAnd_InvokesEveryPolicy(t *testing.T) {
+	calls := 0
+	counting := func(err error) bool {
+		calls++
+		return true
+	}
+
+	counter := 0
+	err := Retry(And(SimpleRetryPolicy(3), counting), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 3, counter)
+	// The counting policy is invoked for the final decision as well
+	assert.Equal(t, 3, calls)
+}
+
+func TestAnd_SleepingPolicies(t *testing.T) {
+	// Both policies agree to retry once, so both of their delays are waited
+	start := time.Now()
+	err := Retry(And(FixedRetryPolicy(2, 30*time.Millisecond), FixedRetryPolicy(2, 30*time.Millisecond)), func() error {
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	assert.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+}
+
+func TestAnd_Reused(t *testing.T) {
+	policy := And(SimpleRetryPolicy(3), FixedRetryPolicy(5, time.Millisecond))
+	for i := 0; i < 2; i++ {
+		counter := 0
+		err := Retry(policy, func() error {
+			counter++
+			return fmt.Errorf("oh snap this broke")
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 3, counter)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	policy := Limit(3, func(error) bool {
+		return true
+	})
+	for i := 0; i < 2; i++ {
+		counter := 0
+		err := Retry(policy, func() error {
+			counter++
+			return fmt.Errorf("oh snap this broke")
+		})
+
+		assert.ErrorAs(t, err, &UnrecoverableError{})
+		assert.Equal(t, 3, counter)
+	}
+
+	// The wrapped policy may still stop earlier
+	counter := 0
+	_ = Retry(Limit(10, SimpleRetryPolicy(2)), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+	assert.Equal(t, 2, counter)
+
+	assert.Panics(t, func() {
+		Limit(0, SimpleRetryPolicy(2))
+	})
+	assert.Panics(t, func() {
+		Limit(3, nil)
+	})
+}
+
+func TestMaxDuration(t *testing.T) {
+	policy := MaxDuration(50*time.Millisecond, FixedRetryPolicy(100, 10*time.Millisecond))
+	for i := 0; i < 2; i++ {
+		counter := 0
+		start := time.Now()
+		err := Retry(policy, func() error {
+			counter++
+			return fmt.Errorf("oh snap this broke")
+		})
+
+		assert.ErrorAs(t, err, &UnrecoverableError{})
+		assert.Greater(t, counter, 2)
+		assert.Less(t, counter, 10)
+		assert.Less(t, time.Since(start), 200*time.Millisecond)
+	}
+
+	assert.Panics(t, func() {
+		MaxDuration(time.Second, nil)
+	})
+}
@@ -0,0 +1,51 @@
+package riprovare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrConditionNotMet is returned by Eventually when the context is done before
+// the condition was met.
+var ErrConditionNotMet = errors.New("condition not met")
+
+// Eventually polls check every interval until it reports true, which is useful
+// for readiness checks and tests of eventually consistent systems. If check
+// returns an error polling stops immediately and the error is returned. If ctx
+// is done before the condition is met an error matching both ErrConditionNotMet
+// and the error of the context is returned.
+//
+// A nil check will cause a panic.
+func Eventually(ctx context.Context, interval time.Duration, check func() (bool, error)) error {
+	if check == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+
+	var checkErr error
+	err := Retry(func(err error) bool {
+		return errors.Is(err, ErrConditionNotMet)
+	}, func() error {
+		ok, err := check()
+		if err != nil {
+			checkErr = err
+			return err
+		}
+		if !ok {
+			return ErrConditionNotMet
+		}
+		return nil
+	}, WithContext(ctx), WithDelayFunc(func(attempt int, err error) time.Duration {
+		return interval
+	}))
+
+	switch {
+	case checkErr != nil:
+		return checkErr
+	case err != nil:
+		return fmt.Errorf("%w: %w", ErrConditionNotMet, ctx.Err())
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,50 @@
+package riprovare
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventually(t *testing.T) {
+	counter := 0
+	err := Eventually(context.Background(), 10*time.Millisecond, func() (bool, error) {
+		counter++
+		return counter == 3, nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, counter)
+}
+
+func TestEventually_Timeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := Eventually(ctx, 10*time.Millisecond, func() (bool, error) {
+		return false, nil
+	})
+
+	assert.ErrorIs(t, err, ErrConditionNotMet)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestEventually_TerminalError(t *testing.T) {
+	errBroken := errors.New("oh snap this broke")
+	counter := 0
+	err := Eventually(context.Background(), 10*time.Millisecond, func() (bool, error) {
+		counter++
+		if counter == 2 {
+			return false, errBroken
+		}
+		return false, nil
+	})
+
+	assert.Equal(t, errBroken, err)
+	assert.Equal(t, 2, counter)
+}
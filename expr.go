@@ -0,0 +1,319 @@
+package riprovare
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// CompileBackoff compiles a backoff expression into a BackoffFunc, allowing
+// backoff curves to be defined in configuration. For example:
+//
+//	min(30s, 100ms * 2^n)
+//	max(1s, 250ms * n)
+//	500ms + 100ms * n
+//
+// The variable n is the 1-based number of the attempt that failed. Expressions
+// may contain duration literals in the format accepted by time.ParseDuration,
+// numbers, the operators +, * and ^ (exponentiation), parentheses and the
+// functions min and max, which accept two or more arguments. The expression
+// must evaluate to a duration, durations may be scaled by numbers but not
+// multiplied with each other. Negative results are treated as zero and results
+// too large to be represented are capped at the maximum duration.
+//
+// Any other tokens are rejected with an error describing the problem.
+func CompileBackoff(expr string) (BackoffFunc, error) {
+	p := &exprParser{expr: expr}
+	root, kind, err := p.parseSum()
+	if err == nil && p.pos < len(p.expr) {
+		err = p.errorf("unexpected %q", p.expr[p.pos:])
+	}
+	if err == nil && kind != durationKind {
+		err = fmt.Errorf("invalid backoff expression %q: must evaluate to a duration", expr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func(attempt int) time.Duration {
+		v := root.eval(float64(attempt))
+		switch {
+		case math.IsNaN(v) || v <= 0:
+			return 0
+		case v >= math.MaxInt64:
+			return math.MaxInt64
+		default:
+			return time.Duration(v)
+		}
+	}, nil
+}
+
+type exprKind int
+
+const (
+	numberKind exprKind = iota
+	durationKind
+)
+
+// exprNode is a node of a compiled backoff expression. Durations are evaluated
+// as nanoseconds.
+type exprNode interface {
+	eval(n float64) float64
+}
+
+type exprLiteral float64
+
+func (l exprLiteral) eval(float64) float64 {
+	return float64(l)
+}
+
+type exprAttempt struct{}
+
+func (exprAttempt) eval(n float64) float64 {
+	return n
+}
+
+type exprBinary struct {
+	op          byte
+	left, right exprNode
+}
+
+func (b exprBinary) eval(n float64) float64 {
+	l, r := b.left.eval(n), b.right.eval(n)
+	switch b.op {
+	case '+':
+		return l + r
+	case '*':
+		return l * r
+	default:
+		return math.Pow(l, r)
+	}
+}
+
+type exprCall struct {
+	min  bool
+	args []exprNode
+}
+
+func (c exprCall) eval(n float64) float64 {
+	v := c.args[0].eval(n)
+	for _, arg := range c.args[1:] {
+		if c.min {
+			v = math.Min(v, arg.eval(n))
+		} else {
+			v = math.Max(v, arg.eval(n))
+		}
+	}
+	return v
+}
+
+// exprParser is a recursive descent parser for backoff expressions. From lowest
+// to highest precedence the grammar is:
+//
+//	sum     = product { "+" product }
+//	product = power { "*" power }
+//	power   = operand [ "^" power ]
+//	operand = number | duration | "n" | ( "min" | "max" ) "(" sum { "," sum } ")" | "(" sum ")"
+type exprParser struct {
+	expr string
+	pos  int
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("invalid backoff expression %q: %s at position %d", p.expr, fmt.Sprintf(format, args...), p.pos)
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.expr) && (p.expr[p.pos] == ' ' || p.expr[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// consume skips whitespace and advances past c if it is the next character.
+func (p *exprParser) consume(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.expr) && p.expr[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseSum() (exprNode, exprKind, error) {
+	left, kind, err := p.parseProduct()
+	if err != nil {
+		return nil, 0, err
+	}
+	for p.consume('+') {
+		right, rightKind, err := p.parseProduct()
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind != rightKind {
+			return nil, 0, p.errorf("cannot add a number and a duration")
+		}
+		left = exprBinary{op: '+', left: left, right: right}
+	}
+	return left, kind, nil
+}
+
+func (p *exprParser) parseProduct() (exprNode, exprKind, error) {
+	left, kind, err := p.parsePower()
+	if err != nil {
+		return nil, 0, err
+	}
+	for p.consume('*') {
+		right, rightKind, err := p.parsePower()
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind == durationKind && rightKind == durationKind {
+			return nil, 0, p.errorf("cannot multiply two durations")
+		}
+		if rightKind == durationKind {
+			kind = durationKind
+		}
+		left = exprBinary{op: '*', left: left, right: right}
+	}
+	return left, kind, nil
+}
+
+func (p *exprParser) parsePower() (exprNode, exprKind, error) {
+	base, kind, err := p.parseOperand()
+	if err != nil {
+		return nil, 0, err
+	}
+	if !p.consume('^') {
+		return base, kind, nil
+	}
+	exp, expKind, err := p.parsePower()
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind == durationKind || expKind == durationKind {
+		return nil, 0, p.errorf("exponentiation is only supported for numbers")
+	}
+	return exprBinary{op: '^', left: base, right: exp}, numberKind, nil
+}
+
+func (p *exprParser) parseOperand() (exprNode, exprKind, error) {
+	p.skipSpace()
+	if p.pos >= len(p.expr) {
+		return nil, 0, p.errorf("unexpected end of expression")
+	}
+
+	c := p.expr[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		node, kind, err := p.parseSum()
+		if err != nil {
+			return nil, 0, err
+		}
+		if !p.consume(')') {
+			return nil, 0, p.errorf("expected )")
+		}
+		return node, kind, nil
+	case c >= '0' && c <= '9' || c == '.':
+		return p.parseLiteral()
+	case unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.expr) && unicode.IsLetter(rune(p.expr[p.pos])) {
+			p.pos++
+		}
+		switch ident := p.expr[start:p.pos]; ident {
+		case "n":
+			return exprAttempt{}, numberKind, nil
+		case "min", "max":
+			return p.parseCall(ident == "min")
+		default:
+			p.pos = start
+			return nil, 0, p.errorf("unknown identifier %q", ident)
+		}
+	default:
+		return nil, 0, p.errorf("unexpected %q", c)
+	}
+}
+
+// parseLiteral parses a number or, if it is directly followed by a unit, a
+// duration.
+func (p *exprParser) parseLiteral() (exprNode, exprKind, error) {
+	start := p.pos
+	isDuration := false
+	for p.pos < len(p.expr) {
+		c := p.expr[p.pos]
+		if c >= '0' && c <= '9' || c == '.' {
+			p.pos++
+			continue
+		}
+		if c >= 'a' && c <= 'z' {
+			isDuration = true
+			p.pos++
+			continue
+		}
+		// time.ParseDuration accepts both the micro sign and the Greek letter mu
+		if mu := muPrefix(p.expr[p.pos:]); mu != "" {
+			isDuration = true
+			p.pos += len(mu)
+			continue
+		}
+		break
+	}
+
+	literal := p.expr[start:p.pos]
+	if isDuration {
+		d, err := time.ParseDuration(literal)
+		if err != nil {
+			p.pos = start
+			return nil, 0, p.errorf("invalid duration %q", literal)
+		}
+		return exprLiteral(d), durationKind, nil
+	}
+	f, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		p.pos = start
+		return nil, 0, p.errorf("invalid number %q", literal)
+	}
+	return exprLiteral(f), numberKind, nil
+}
+
+func muPrefix(s string) string {
+	for _, mu := range []string{"\u00b5", "\u03bc"} {
+		if strings.HasPrefix(s, mu) {
+			return mu
+		}
+	}
+	return ""
+}
+
+func (p *exprParser) parseCall(isMin bool) (exprNode, exprKind, error) {
+	if !p.consume('(') {
+		return nil, 0, p.errorf("expected (")
+	}
+	var args []exprNode
+	var kind exprKind
+	for {
+		arg, argKind, err := p.parseSum()
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(args) > 0 && argKind != kind {
+			return nil, 0, p.errorf("cannot compare a number and a duration")
+		}
+		args = append(args, arg)
+		kind = argKind
+		if !p.consume(',') {
+			break
+		}
+	}
+	if !p.consume(')') {
+		return nil, 0, p.errorf("expected )")
+	}
+	if len(args) < 2 {
+		return nil, 0, p.errorf("min and max require at least two arguments")
+	}
+	return exprCall{min: isMin, args: args}, kind, nil
+}
@@ -0,0 +1,92 @@
+package riprovare
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileBackoff(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected []time.Duration
+	}{
+		{
+			expr:     "min(30s, 100ms * 2^n)",
+			expected: []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond},
+		},
+		{
+			expr:     "min(1s, 100ms * 2^n)",
+			expected: []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second},
+		},
+		{
+			expr:     "max(1s, 250ms*n)",
+			expected: []time.Duration{time.Second, time.Second, time.Second, time.Second, 1250 * time.Millisecond},
+		},
+		{
+			expr:     "500ms + 100ms * n",
+			expected: []time.Duration{600 * time.Millisecond, 700 * time.Millisecond},
+		},
+		{
+			expr:     "1m30s",
+			expected: []time.Duration{90 * time.Second, 90 * time.Second},
+		},
+		{
+			expr:     "100µs * (n + 1) ^ 2",
+			expected: []time.Duration{400 * time.Microsecond, 900 * time.Microsecond},
+		},
+		{
+			expr:     "min(5s, 1s * 2 ^ n, 3s)",
+			expected: []time.Duration{2 * time.Second, 3 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			backoff, err := CompileBackoff(test.expr)
+			assert.NoError(t, err)
+			for i, expected := range test.expected {
+				assert.Equal(t, expected, backoff(i+1))
+			}
+		})
+	}
+}
+
+func TestCompileBackoff_Overflow(t *testing.T) {
+	backoff, err := CompileBackoff("1h * 10^n")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(math.MaxInt64), backoff(100))
+}
+
+func TestCompileBackoff_Invalid(t *testing.T) {
+	tests := []struct {
+		expr string
+		msg  string
+	}{
+		{expr: "", msg: "unexpected end of expression"},
+		{expr: "2^n", msg: "must evaluate to a duration"},
+		{expr: "1s * 1s", msg: "cannot multiply two durations"},
+		{expr: "1s ^ 2", msg: "exponentiation is only supported for numbers"},
+		{expr: "1s + 2", msg: "cannot add a number and a duration"},
+		{expr: "min(1s, 2)", msg: "cannot compare a number and a duration"},
+		{expr: "min(1s)", msg: "at least two arguments"},
+		{expr: "min(1s, 2s", msg: "expected )"},
+		{expr: "(1s", msg: "expected )"},
+		{expr: "10xs", msg: "invalid duration \"10xs\""},
+		{expr: "1..2 * 1s", msg: "invalid number"},
+		{expr: "exec(1s)", msg: "unknown identifier \"exec\""},
+		{expr: "1s; rm", msg: "unexpected \"; rm\""},
+		{expr: "1s - n", msg: "unexpected \"- n\""},
+		{expr: "1s * $n", msg: "unexpected '$'"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			backoff, err := CompileBackoff(test.expr)
+			assert.Nil(t, backoff)
+			assert.ErrorContains(t, err, test.msg)
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package riprovare
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultStatusCodes are the HTTP status codes DoHTTP retries unless configured
+// otherwise using WithRetryableStatusCodes.
+var defaultStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// StatusError is the error of an attempt that received a response with an
+// unsuccessful status code, returned by DoHTTP and CheckResponse. Response is
+// the response that was received, DoHTTP has already closed its body.
+type StatusError struct {
+	StatusCode int
+	Response   *http.Response
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("riprovare: HTTP status %d %s", s.StatusCode, http.StatusText(s.StatusCode))
+}
+
+// retryAfterError carries the delay requested by the Retry-After header of a
+// response. It is only used if the response had the header, as a
+// RetryAfterCarrier requesting no delay overrides the delays of the policies.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (r retryAfterError) Error() string {
+	return r.err.Error()
+}
+
+func (r retryAfterError) Unwrap() error {
+	return r.err
+}
+
+func (r retryAfterError) RetryAfter() time.Duration {
+	return r.after
+}
+
+// RetryableStatusCode reports whether responses with the HTTP status code are
+// retried by default, which is the case for 429, 502, 503 and 504.
+func RetryableStatusCode(code int) bool {
+	return retryableStatus(code, defaultStatusCodes)
+}
+
+// CheckResponse classifies an HTTP response for retries made by a Retryable. It
+// returns nil for status codes less than 400, a *StatusError for retryable
+// status codes as reported by RetryableStatusCode, honoring the Retry-After
+// header of the response, and a *StatusError wrapped by Permanent for any other
+// status code, so Retry stops immediately. The body of the response is neither
+// read nor closed.
+//
+// A nil Response will cause a panic.
+func CheckResponse(res *http.Response) error {
+	if res == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil Response"))
+	}
+	switch {
+	case res.StatusCode < 400:
+		return nil
+	case RetryableStatusCode(res.StatusCode):
+		return statusError(res)
+	default:
+		return Permanent(&StatusError{StatusCode: res.StatusCode, Response: res})
+	}
+}
+
+// statusError returns the error of a response with a retryable status code,
+// carrying the delay requested by its Retry-After header.
+func statusError(res *http.Response) error {
+	err := &StatusError{StatusCode: res.StatusCode, Response: res}
+	if after, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+		return retryAfterError{err: err, after: after}
+	}
+	return err
+}
+
+// WithRetryableStatusCodes sets the HTTP status codes DoHTTP retries, instead of
+// 429, 502, 503 and 504. It has no effect on the other functions of this
+// package.
+func WithRetryableStatusCodes(codes ...int) Option {
+	codes = append([]int(nil), codes...)
+	return func(r *retry) {
+		r.statusCodes = codes
+	}
+}
+
+// DoHTTP sends req using client and retries according to the RetryPolicy if the
+// request fails to be sent or the response has a retryable status code, by
+// default 429, 502, 503 or 504. Every attempt is made with ctx, so the retries
+// stop once ctx is done, and the delay requested by the Retry-After header of a
+// response is honored. The responses of failed attempts are closed after
+// reading at most 4 KiB of their body, so the connection can be reused. The
+// response of the first attempt that succeeded is returned, including responses
+// with a status code that is not retried. If retries are exhausted the error
+// wraps a *StatusError for responses with a retryable status code.
+//
+// A request body is rewound between attempts using GetBody, which
+// http.NewRequest sets for common body types. If req has a body but no GetBody
+// an error is returned without sending the request, rather than sending an
+// empty body on retry. A nil client uses http.DefaultClient.
+//
+// A nil Context, RetryPolicy or Request will cause a panic.
+func DoHTTP(ctx context.Context, client *http.Client, req *http.Request, policy RetryPolicy, opts ...Option) (*http.Response, error) {
+	if req == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil Request"))
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return nil, fmt.Errorf("riprovare: request body cannot be rewound for retries, GetBody is nil")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	statusCodes := defaultStatusCodes
+	opts = append(opts[:len(opts):len(opts)], func(r *retry) {
+		if r.statusCodes != nil {
+			statusCodes = r.statusCodes
+		}
+	})
+
+	var resp *http.Response
+	first := true
+	err := RetryCtx(ctx, policy, func(ctx context.Context) error {
+		attemptReq := req.Clone(ctx)
+		if !first && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return Permanent(err)
+			}
+			attemptReq.Body = body
+		}
+		first = false
+
+		res, err := client.Do(attemptReq)
+		if err != nil {
+			return err
+		}
+		if !retryableStatus(res.StatusCode, statusCodes) {
+			resp = res
+			return nil
+		}
+		// Drain the body so the connection can be reused, a body longer than
+		// maxDrain isn't worth waiting for
+		_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, maxDrain))
+		_ = res.Body.Close()
+		return statusError(res)
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// maxDrain is the most DoHTTP reads of the body of a response that is retried.
+const maxDrain = 4 << 10
+
+func retryableStatus(code int, codes []int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date, reporting false for missing and invalid
+// values. Negative delays and dates in the past are treated as zero.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		switch {
+		case seconds <= 0:
+			return 0, true
+		case seconds > math.MaxInt64/int(time.Second):
+			return math.MaxInt64, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := time.Until(date); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
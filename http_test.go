@@ -0,0 +1,246 @@
+package riprovare
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoHTTP(t *testing.T) {
+	var calls int32
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("payload"))
+	assert.NoError(t, err)
+	resp, err := DoHTTP(context.Background(), server.Client(), req, SimpleRetryPolicy(5))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", string(body))
+	// The body is rewound for every attempt
+	assert.Equal(t, []string{"payload", "payload", "payload"}, bodies)
+}
+
+func TestDoHTTP_Exhausted(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := DoHTTP(context.Background(), nil, req, SimpleRetryPolicy(3))
+
+	var statusErr *StatusError
+	assert.Nil(t, resp)
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusBadGateway, statusErr.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestDoHTTP_EndlessBody(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		chunk := []byte(strings.Repeat("x", 1024))
+		for r.Context().Err() == nil {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := DoHTTP(context.Background(), server.Client(), req, SimpleRetryPolicy(3))
+		done <- err
+	}()
+
+	// The body of a retried response is only drained partially
+	select {
+	case err := <-done:
+		assert.ErrorAs(t, err, &UnrecoverableError{})
+		assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	case <-time.After(5 * time.Second):
+		t.Fatal("DoHTTP blocked draining an endless body")
+	}
+}
+
+func TestDoHTTP_StatusCodes(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := DoHTTP(context.Background(), nil, req, SimpleRetryPolicy(3), WithRetryableStatusCodes(http.StatusInternalServerError))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	// 503 is no longer retried
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestDoHTTP_RetryAfter(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	for _, policy := range []RetryPolicy{FixedRetryPolicy(3, time.Millisecond), SimpleRetryPolicy(3)} {
+		atomic.StoreInt32(&calls, 0)
+		start := time.Now()
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		resp, err := DoHTTP(context.Background(), nil, req, policy)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	}
+}
+
+func TestDoHTTP_ContextDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	_, err := DoHTTP(ctx, nil, req, FixedRetryPolicy(10, time.Hour))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDoHTTP_BodyWithoutGetBody(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	req.Body = io.NopCloser(strings.NewReader("payload"))
+	_, err := DoHTTP(context.Background(), nil, req, SimpleRetryPolicy(3))
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		code      int
+		retryable bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNotModified, false},
+		{http.StatusBadRequest, false},
+		{http.StatusNotFound, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusGatewayTimeout, true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.code), func(t *testing.T) {
+			res := &http.Response{StatusCode: tt.code, Header: http.Header{}}
+			err := CheckResponse(res)
+			assert.Equal(t, tt.retryable, RetryableStatusCode(tt.code))
+			if tt.code < 400 {
+				assert.NoError(t, err)
+				return
+			}
+
+			var statusErr *StatusError
+			assert.ErrorAs(t, err, &statusErr)
+			assert.Equal(t, tt.code, statusErr.StatusCode)
+			assert.Same(t, res, statusErr.Response)
+			assert.Equal(t, fmt.Sprintf("riprovare: HTTP status %d %s", tt.code, http.StatusText(tt.code)), statusErr.Error())
+
+			attempts, _ := RetryN(SimpleRetryPolicy(3), func() error {
+				return CheckResponse(res)
+			})
+			if tt.retryable {
+				assert.Equal(t, 3, attempts)
+			} else {
+				assert.Equal(t, 1, attempts)
+			}
+		})
+	}
+
+	res := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"7"}}}
+	var carrier RetryAfterCarrier
+	assert.ErrorAs(t, CheckResponse(res), &carrier)
+	assert.Equal(t, 7*time.Second, carrier.RetryAfter())
+
+	assert.Panics(t, func() {
+		_ = CheckResponse(nil)
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{value: "", delay: 0, ok: false},
+		{value: "soon", delay: 0, ok: false},
+		{value: "3", delay: 3 * time.Second, ok: true},
+		{value: "-3", delay: 0, ok: true},
+		{value: "Wed, 21 Oct 2015 07:28:00 GMT", delay: 0, ok: true},
+	}
+	for _, test := range tests {
+		delay, ok := parseRetryAfter(test.value)
+		assert.Equal(t, test.delay, delay, test.value)
+		assert.Equal(t, test.ok, ok, test.value)
+	}
+
+	d, ok := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.Greater(t, d, 50*time.Second)
+	assert.LessOrEqual(t, d, time.Minute)
+}
@@ -0,0 +1,56 @@
+package riprovare
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// transientErrnos are the system call errors caused by connections being
+// refused, reset or closed by the peer, which usually succeed when retried.
+var transientErrnos = []error{
+	syscall.ECONNREFUSED,
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.EPIPE,
+}
+
+// IsTransientNetworkError reports whether err is a network failure that is
+// likely to succeed when retried. These are timeouts reported by a net.Error,
+// connections that were refused, reset or aborted, connections closed by the
+// peer with an unexpected EOF and temporary DNS failures. Errors caused by a
+// canceled Context or a Context whose deadline was exceeded are not transient,
+// the timeouts of WithPerAttemptTimeout are.
+//
+// It can be used with RetryIf to build custom classifications, see
+// RetryNetworkErrors.
+func IsTransientNetworkError(err error) bool {
+	if err == nil || contextDone(err) {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) {
+		return false
+	}
+	return netErr.Timeout() || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// RetryNetworkErrors only retries errors IsTransientNetworkError considers
+// transient, any other error stops retries immediately and is returned wrapped
+// in an AbandonedError. It is a shorthand for RetryIf(IsTransientNetworkError),
+// only the last of the two passed takes effect.
+func RetryNetworkErrors() Option {
+	return RetryIf(IsTransientNetworkError)
+}
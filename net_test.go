@@ -0,0 +1,59 @@
+package riprovare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransientNetworkError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain", errors.New("boom"), false},
+		{"reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{"refused", fmt.Errorf("dial: %w", syscall.ECONNREFUSED), true},
+		{"eof", &url.Error{Op: "Get", URL: "http://localhost", Err: io.EOF}, true},
+		{"bare eof", io.EOF, false},
+		{"timeout", &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{IsTimeout: true}}, true},
+		{"dns temporary", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{"dns not found", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"deadline exceeded", context.DeadlineExceeded, false},
+		{"canceled", &url.Error{Op: "Get", URL: "http://localhost", Err: context.Canceled}, false},
+		{"attempt timeout", attemptTimeoutError{err: context.DeadlineExceeded}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsTransientNetworkError(tt.err))
+		})
+	}
+}
+
+func TestRetryNetworkErrors(t *testing.T) {
+	errs := []error{
+		&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET},
+		&net.DNSError{Err: "no such host", IsNotFound: true},
+	}
+	counter := 0
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		err := errs[counter]
+		counter++
+		return err
+	}, RetryNetworkErrors())
+
+	var abandoned AbandonedError
+	assert.ErrorAs(t, err, &abandoned)
+	assert.Equal(t, ReasonNotRetryable, abandoned.Reason)
+	assert.Equal(t, 2, counter)
+}
@@ -0,0 +1,57 @@
+package riprovare
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Result holds the outcome of processing a single item with RetryPipe. Err is
+// nil when Value was produced successfully, otherwise it is the error returned
+// by Retry once retries for the item were exhausted.
+type Result[R any] struct {
+	Value R
+	Err   error
+}
+
+// RetryPipe processes every item received from in using process, retrying each
+// item independently, and emits the outcome of every item on the returned
+// channel. At most workers items are processed concurrently, so results are not
+// necessarily emitted in the order items were received. Each item is retried
+// with a fresh RetryPolicy created by policy. The returned channel is closed once
+// in has been closed and all items have been processed.
+//
+// A nil process or policy, or fewer than one worker will cause a panic.
+func RetryPipe[T, R any](in <-chan T, process func(T) (R, error), policy func() RetryPolicy, workers int, opts ...Option) <-chan Result[R] {
+	if process == nil || policy == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	if workers < 1 {
+		panic(fmt.Errorf("illegal use of api: RetryPipe requires at least one worker"))
+	}
+
+	out := make(chan Result[R])
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range in {
+				var res Result[R]
+				res.Err = Retry(policy(), func() error {
+					value, err := process(item)
+					if err != nil {
+						return err
+					}
+					res.Value = value
+					return nil
+				}, opts...)
+				out <- res
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
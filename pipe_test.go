@@ -0,0 +1,92 @@
+package riprovare
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPipe(t *testing.T) {
+	in := make(chan int)
+	go func() {
+		for i := 1; i <= 10; i++ {
+			in <- i
+		}
+		close(in)
+	}()
+
+	var mu sync.Mutex
+	attempts := make(map[int]int)
+	out := RetryPipe(in, func(item int) (int, error) {
+		mu.Lock()
+		attempts[item]++
+		n := attempts[item]
+		mu.Unlock()
+
+		// Odd items never succeed, even items succeed on their second attempt
+		if item%2 == 1 || n < 2 {
+			return 0, fmt.Errorf("failed to process %d", item)
+		}
+		return item * 10, nil
+	}, func() RetryPolicy {
+		return SimpleRetryPolicy(3)
+	}, 3)
+
+	succeeded := 0
+	failed := 0
+	for res := range out {
+		if res.Err != nil {
+			failed++
+			assert.ErrorAs(t, res.Err, &UnrecoverableError{})
+			continue
+		}
+		succeeded++
+		assert.Equal(t, 0, res.Value%20)
+	}
+
+	assert.Equal(t, 5, succeeded)
+	assert.Equal(t, 5, failed)
+	for item, n := range attempts {
+		if item%2 == 1 {
+			assert.Equal(t, 3, n)
+		} else {
+			assert.Equal(t, 2, n)
+		}
+	}
+}
+
+func TestRetryPipe_Concurrency(t *testing.T) {
+	in := make(chan int, 20)
+	for i := 0; i < 20; i++ {
+		in <- i
+	}
+	close(in)
+
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	out := RetryPipe(in, func(item int) (int, error) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		return item, nil
+	}, func() RetryPolicy {
+		return SimpleRetryPolicy(1)
+	}, 4)
+
+	count := 0
+	for range out {
+		count++
+	}
+	assert.Equal(t, 20, count)
+	assert.LessOrEqual(t, maxActive, 4)
+}
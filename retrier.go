@@ -0,0 +1,243 @@
+package riprovare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default values used by RetrierFromEnv for variables that are not set.
+const (
+	DefaultMaxAttempts  = 3
+	DefaultInitialDelay = 100 * time.Millisecond
+	DefaultMaxDelay     = 30 * time.Second
+	DefaultMultiplier   = 2.0
+	DefaultJitter       = 0.25
+)
+
+// Retrier retries operations using the same configuration, which avoids passing
+// the same RetryPolicy and Options at every call site.
+type Retrier struct {
+	newPolicy     func() RetryPolicy
+	opts          []Option
+	maxGoroutines int
+
+	mu      sync.Mutex
+	queue   []func()
+	workers int
+}
+
+// NewRetrier returns a Retrier that retries operations with the provided
+// Options. Because the built-in RetryPolicy implementations keep track of the
+// attempts made they cannot be shared by concurrent operations, so newPolicy is
+// invoked to create a fresh RetryPolicy for every operation.
+//
+// A nil newPolicy will cause a panic.
+func NewRetrier(newPolicy func() RetryPolicy, opts ...Option) *Retrier {
+	if newPolicy == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	var cfg retry
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &Retrier{
+		newPolicy:     newPolicy,
+		opts:          opts,
+		maxGoroutines: cfg.maxGoroutines,
+	}
+}
+
+// WithMaxGoroutines limits the number of goroutines a Retrier uses to run
+// operations submitted with DoAsync and DoAll to n. Operations submitted while n
+// operations are running are queued and run as soon as a goroutine becomes
+// available, so submitting never blocks. By default, every operation runs in its
+// own goroutine. The option has no effect on Retry and Retrier.Do, which run on
+// the calling goroutine.
+//
+// A limit less than 1 will cause a panic.
+func WithMaxGoroutines(n int) Option {
+	if n < 1 {
+		panic(fmt.Errorf("illegal use of api: max goroutines must be at least 1"))
+	}
+	return func(r *retry) {
+		r.maxGoroutines = n
+	}
+}
+
+// Do invokes fn and retries it according to the configuration of the Retrier.
+// It behaves exactly like Retry.
+func (r *Retrier) Do(fn Retryable) error {
+	return Retry(r.newPolicy(), fn, r.opts...)
+}
+
+// DoCtx invokes fn and retries it according to the configuration of the Retrier,
+// passing ctx to every attempt. It behaves exactly like RetryCtx.
+func (r *Retrier) DoCtx(ctx context.Context, fn RetryableCtx) error {
+	return RetryCtx(ctx, r.newPolicy(), fn, r.opts...)
+}
+
+// DoAsync retries fn like Do on another goroutine. The returned channel receives
+// the result once the operation completes.
+func (r *Retrier) DoAsync(fn Retryable) <-chan error {
+	result := make(chan error, 1)
+	r.submit(func() {
+		result <- r.Do(fn)
+	})
+	return result
+}
+
+// DoAll retries all fns concurrently, each with its own RetryPolicy, and waits
+// for all of them to complete. The errors of the operations that failed are
+// joined using errors.Join, if all operations succeed nil is returned.
+func (r *Retrier) DoAll(fns ...Retryable) error {
+	results := make([]<-chan error, len(fns))
+	for i, fn := range fns {
+		results[i] = r.DoAsync(fn)
+	}
+	errs := make([]error, len(fns))
+	for i, result := range results {
+		errs[i] = <-result
+	}
+	return errors.Join(errs...)
+}
+
+// RetryAll retries all fns concurrently, each on its own goroutine with a fresh
+// RetryPolicy created by policy, and waits for all of them to complete. The
+// errors of the operations that failed are joined using errors.Join, if all
+// operations succeed nil is returned. It is a shorthand for DoAll of a Retrier
+// created with NewRetrier.
+//
+// A nil policy will cause a panic.
+func RetryAll(policy func() RetryPolicy, fns []Retryable, opts ...Option) error {
+	return NewRetrier(policy, opts...).DoAll(fns...)
+}
+
+// submit runs task on another goroutine. If the number of goroutines is limited
+// the task is queued and a new worker is only started while the limit hasn't
+// been reached, otherwise one of the running workers picks it up.
+func (r *Retrier) submit(task func()) {
+	if r.maxGoroutines == 0 {
+		go task()
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queue = append(r.queue, task)
+	if r.workers < r.maxGoroutines {
+		r.workers++
+		go r.work()
+	}
+}
+
+// work runs queued tasks until the queue is empty.
+func (r *Retrier) work() {
+	for {
+		r.mu.Lock()
+		if len(r.queue) == 0 {
+			r.workers--
+			r.mu.Unlock()
+			return
+		}
+		task := r.queue[0]
+		r.queue[0] = nil
+		r.queue = r.queue[1:]
+		r.mu.Unlock()
+		task()
+	}
+}
+
+// RetrierFromEnv returns a Retrier using exponential backoff configured from
+// environment variables, allowing retries to be tuned without code changes. The
+// following variables are read, where PREFIX is the provided prefix:
+//
+//	PREFIX_MAX_ATTEMPTS   total attempts, including the first (default 3)
+//	PREFIX_INITIAL_DELAY  delay after the first failed attempt (default 100ms)
+//	PREFIX_MAX_DELAY      upper bound of any delay (default 30s)
+//	PREFIX_MULTIPLIER     factor the delay grows by after each attempt (default 2)
+//	PREFIX_JITTER         fraction the delay is randomly varied by, from 0 to 1 (default 0.25)
+//
+// Durations use the format accepted by time.ParseDuration. If a variable holds
+// an invalid value a descriptive error is returned.
+func RetrierFromEnv(prefix string) (*Retrier, error) {
+	if prefix != "" {
+		prefix += "_"
+	}
+
+	maxAttempts := DefaultMaxAttempts
+	if v, ok := os.LookupEnv(prefix + "MAX_ATTEMPTS"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid value %q for %sMAX_ATTEMPTS: must be an integer greater than 0", v, prefix)
+		}
+		maxAttempts = n
+	}
+
+	initialDelay, err := durationFromEnv(prefix+"INITIAL_DELAY", DefaultInitialDelay)
+	if err != nil {
+		return nil, err
+	}
+	maxDelay, err := durationFromEnv(prefix+"MAX_DELAY", DefaultMaxDelay)
+	if err != nil {
+		return nil, err
+	}
+	if maxDelay < initialDelay {
+		return nil, fmt.Errorf("invalid value %s for %sMAX_DELAY: must not be less than the initial delay %s",
+			maxDelay, prefix, initialDelay)
+	}
+
+	multiplier := DefaultMultiplier
+	if v, ok := os.LookupEnv(prefix + "MULTIPLIER"); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 1 || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("invalid value %q for %sMULTIPLIER: must be a number of at least 1", v, prefix)
+		}
+		multiplier = f
+	}
+
+	jitter := DefaultJitter
+	if v, ok := os.LookupEnv(prefix + "JITTER"); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 || math.IsNaN(f) {
+			return nil, fmt.Errorf("invalid value %q for %sJITTER: must be a number between 0 and 1", v, prefix)
+		}
+		jitter = f
+	}
+
+	return NewRetrier(func() RetryPolicy {
+		return SimpleRetryPolicy(maxAttempts)
+	}, WithDelayFunc(exponentialDelay(initialDelay, maxDelay, multiplier, jitter))), nil
+}
+
+func durationFromEnv(key string, def time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid value %q for %s: must be a non-negative duration such as 250ms", v, key)
+	}
+	return d, nil
+}
+
+// exponentialDelay returns a DelayFunc where the delay after attempt n is
+// initial * multiplier^(n-1), varied randomly by +/- jitter and never exceeding
+// max.
+func exponentialDelay(initial, max time.Duration, multiplier, jitter float64) DelayFunc {
+	return func(attempt int, _ error) time.Duration {
+		d := float64(exponentialScaled(initial, multiplier, attempt-1))
+		if jitter > 0 {
+			d *= 1 - jitter + defaultRand.Float64()*2*jitter
+		}
+		if d > float64(max) {
+			return max
+		}
+		return time.Duration(d)
+	}
+}
@@ -0,0 +1,254 @@
+package riprovare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrier_Do(t *testing.T) {
+	retrier := NewRetrier(func() RetryPolicy {
+		return SimpleRetryPolicy(3)
+	})
+
+	for i := 0; i < 2; i++ {
+		counter := 0
+		err := retrier.Do(func() error {
+			counter++
+			return fmt.Errorf("oh snap this broke")
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 3, counter)
+	}
+}
+
+func TestRetrier_DoConcurrent(t *testing.T) {
+	// A single Retrier holding the configured policy is shared by all goroutines
+	retrier := NewRetrier(func() RetryPolicy {
+		return FixedRetryPolicy(3, time.Millisecond)
+	})
+
+	counters := make([]int, 50)
+	var wg sync.WaitGroup
+	for i := range counters {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := retrier.Do(func() error {
+				counters[i]++
+				return fmt.Errorf("oh snap this broke")
+			})
+			assert.Error(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	// Every operation gets all of its attempts
+	for _, counter := range counters {
+		assert.Equal(t, 3, counter)
+	}
+}
+
+func TestRetrier_DoCtx(t *testing.T) {
+	retrier := NewRetrier(func() RetryPolicy {
+		return SimpleRetryPolicy(3)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	counter := 0
+	err := retrier.DoCtx(ctx, func(ctx context.Context) error {
+		counter++
+		if counter == 2 {
+			cancel()
+		}
+		return fmt.Errorf("oh snap this broke")
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 2, counter)
+}
+
+func TestRetrier_DoAsync(t *testing.T) {
+	retrier := NewRetrier(func() RetryPolicy {
+		return SimpleRetryPolicy(3)
+	})
+
+	counter := int32(0)
+	result := retrier.DoAsync(func() error {
+		if atomic.AddInt32(&counter, 1) < 2 {
+			return fmt.Errorf("oh snap this broke")
+		}
+		return nil
+	})
+	assert.NoError(t, <-result)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&counter))
+}
+
+func TestRetrier_DoAll(t *testing.T) {
+	retrier := NewRetrier(func() RetryPolicy {
+		return SimpleRetryPolicy(2)
+	}, WithMaxGoroutines(2))
+
+	errBroken := errors.New("oh snap this broke")
+	err := retrier.DoAll(func() error {
+		return nil
+	}, func() error {
+		return errBroken
+	}, func() error {
+		return nil
+	})
+
+	unrecoverable := UnrecoverableError{}
+	assert.ErrorAs(t, err, &unrecoverable)
+	assert.Equal(t, errBroken, unrecoverable.Err)
+
+	err = retrier.DoAll(func() error {
+		return nil
+	}, func() error {
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestRetryAll(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	call := func(name string, fail bool) Retryable {
+		return func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[name]++
+			if fail {
+				return fmt.Errorf("%s broke", name)
+			}
+			return nil
+		}
+	}
+
+	err := RetryAll(func() RetryPolicy {
+		return SimpleRetryPolicy(3)
+	}, []Retryable{call("first", true), call("second", false), call("third", true)})
+
+	assert.ErrorContains(t, err, "first broke")
+	assert.ErrorContains(t, err, "third broke")
+	assert.NotContains(t, err.Error(), "second")
+	assert.Equal(t, map[string]int{"first": 3, "second": 1, "third": 3}, calls)
+	assert.NoError(t, RetryAll(func() RetryPolicy {
+		return SimpleRetryPolicy(3)
+	}, nil))
+}
+
+func TestRetrier_MaxGoroutines(t *testing.T) {
+	retrier := NewRetrier(func() RetryPolicy {
+		return SimpleRetryPolicy(2)
+	}, WithMaxGoroutines(4))
+
+	baseline := runtime.NumGoroutine()
+	var active, maxActive int32
+	maxGoroutines := 0
+	results := make([]<-chan error, 200)
+	for i := range results {
+		results[i] = retrier.DoAsync(func() error {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				max := atomic.LoadInt32(&maxActive)
+				if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return fmt.Errorf("oh snap this broke")
+		})
+		if n := runtime.NumGoroutine() - baseline; n > maxGoroutines {
+			maxGoroutines = n
+		}
+	}
+	for _, result := range results {
+		assert.Error(t, <-result)
+	}
+
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxActive), int32(4))
+	assert.LessOrEqual(t, maxGoroutines, 4)
+}
+
+func TestRetrierFromEnv(t *testing.T) {
+	t.Setenv("TEST_MAX_ATTEMPTS", "5")
+	t.Setenv("TEST_INITIAL_DELAY", "1ms")
+	t.Setenv("TEST_MAX_DELAY", "5ms")
+	t.Setenv("TEST_MULTIPLIER", "3")
+	t.Setenv("TEST_JITTER", "0")
+
+	retrier, err := RetrierFromEnv("TEST")
+	assert.NoError(t, err)
+
+	counter := 0
+	err = retrier.Do(func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 5, counter)
+
+	var delays []time.Duration
+	delay := exponentialDelay(time.Millisecond, 5*time.Millisecond, 3, 0)
+	for i := 1; i <= 4; i++ {
+		delays = append(delays, delay(i, nil))
+	}
+	assert.Equal(t, []time.Duration{time.Millisecond, 3 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond}, delays)
+
+	// A multiplier of 2 is computed by shifting which stays exact
+	delays = nil
+	delay = exponentialDelay(3*time.Nanosecond, time.Hour, 2, 0)
+	for i := 1; i <= 4; i++ {
+		delays = append(delays, delay(i, nil))
+	}
+	assert.Equal(t, []time.Duration{3, 6, 12, 24}, delays)
+}
+
+func TestRetrierFromEnv_Partial(t *testing.T) {
+	t.Setenv("PARTIAL_MAX_ATTEMPTS", "2")
+	t.Setenv("PARTIAL_INITIAL_DELAY", "1ms")
+
+	retrier, err := RetrierFromEnv("PARTIAL")
+	assert.NoError(t, err)
+
+	counter := 0
+	err = retrier.Do(func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 2, counter)
+}
+
+func TestRetrierFromEnv_Invalid(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+	}{
+		{key: "INVALID_MAX_ATTEMPTS", value: "zero"},
+		{key: "INVALID_MAX_ATTEMPTS", value: "0"},
+		{key: "INVALID_INITIAL_DELAY", value: "10"},
+		{key: "INVALID_MAX_DELAY", value: "1ns"},
+		{key: "INVALID_MULTIPLIER", value: "0.5"},
+		{key: "INVALID_MULTIPLIER", value: "NaN"},
+		{key: "INVALID_JITTER", value: "2"},
+		{key: "INVALID_JITTER", value: "NaN"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.key+"="+test.value, func(t *testing.T) {
+			t.Setenv(test.key, test.value)
+			retrier, err := RetrierFromEnv("INVALID")
+			assert.Nil(t, retrier)
+			assert.ErrorContains(t, err, test.key)
+		})
+	}
+}
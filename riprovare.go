@@ -4,79 +4,462 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
 // Retryable is a function that can be retried. If a non-nil error value is
 // returned the function will be retried based on the RetryPolicy.
 type Retryable func() error
 
+// RetryableCtx is a function that can be retried and accepts the context of the
+// operation.
+type RetryableCtx func(ctx context.Context) error
+
+// RetryableAttempt is a function that can be retried and accepts the 1-based
+// number of the attempt, so it can adjust its behavior on retries.
+type RetryableAttempt func(attempt int) error
+
 // RetryPolicy is function type that returns a boolean indicating if operations
 // should continue retrying. An error is accepted that allows for the error value
 // to be inspected. Optionally retries can be abandoned or continue depending on
 // the error value.
+//
+// The attempts accepted by the built-in policies are the total number of times
+// the Retryable is invoked, including the first attempt, so a policy with n
+// attempts retries at most n-1 times.
+//
+// Retry only consults the RetryPolicy after an attempt failed. A nil error means
+// there is nothing to recover from, so the built-in policies return false for it
+// immediately without counting an attempt or sleeping.
+//
+// Retry consults the RetryPolicy with an error wrapping the error of the failed
+// attempt, so the error should be inspected using errors.Is and errors.As
+// rather than by comparing it or asserting its type. The built-in policies
+// don't sleep when consulted with such an error, they hand the delay before the
+// next attempt to Retry, which waits it itself. This holds for built-in policies
+// wrapped by a RetryPolicy implemented by other means as long as the wrapper
+// passes the error it received on, or an error wrapping it. Invoked with any
+// other error the built-in policies sleep before returning. A RetryPolicy
+// implemented by other means may sleep before returning as well, Retry waits
+// for it to return.
+//
+// The built-in policies keep track of the attempts of a single operation. They
+// are reset when Retry consults them for the first time during an operation, so
+// a RetryPolicy can be reused by subsequent calls, but not by concurrent ones.
+// To share a configured policy across goroutines, store a function creating it
+// instead and use a Retrier, which creates a fresh RetryPolicy for every
+// operation.
 type RetryPolicy func(error) bool
 
+// ErrRetriesExhausted matches every UnrecoverableError using errors.Is, which
+// allows detecting that Retry gave up without inspecting the concrete error.
+var ErrRetriesExhausted = errors.New("max retries exceeded")
+
 // OnErrorFunc is a function type that is invoked when an error occurs which provides
 // a hook to log errors, capture metrics, etc.
 type OnErrorFunc func(error)
 
+// Logger is the interface Retry logs through when configured using WithLogger.
+// Logf is invoked with a printf-style format and its arguments, a trailing
+// newline is not included.
+type Logger interface {
+	Logf(format string, args ...any)
+}
+
+// LoggerFunc adapts a printf-style function to a Logger, such as the Printf
+// method of a log.Logger:
+//
+//	logger := log.New(os.Stderr, "payments: ", log.LstdFlags)
+//	err := riprovare.Retry(policy, fn, riprovare.WithLogger(riprovare.LoggerFunc(logger.Printf)))
+type LoggerFunc func(format string, args ...any)
+
+// Logf invokes f.
+func (f LoggerFunc) Logf(format string, args ...any) {
+	f(format, args...)
+}
+
+// NopLogger is a Logger discarding everything. Retry does not log unless
+// WithLogger is used, NopLogger is useful where a Logger is required but
+// logging isn't wanted.
+var NopLogger Logger = LoggerFunc(func(string, ...any) {})
+
+// DeadlineCarrier is implemented by errors that limit how long retrying them
+// makes sense, for example an error referring to a lease that is about to
+// expire. If an attempt fails with an error carrying a deadline, Retry stops
+// once the deadline has passed or if waiting for the next attempt would exceed
+// it. A zero deadline is ignored.
+type DeadlineCarrier interface {
+	RetryDeadline() time.Time
+}
+
+// RetryAfterCarrier is implemented by errors that know how long to wait before
+// retrying, for example an error for an HTTP 429 response carrying the value of
+// the Retry-After header. Whatever the RetryPolicy, Retry waits the duration
+// returned by RetryAfter instead of the delay of the policy and any delay
+// configured using WithDelayFunc. A negative duration is treated as zero.
+type RetryAfterCarrier interface {
+	RetryAfter() time.Duration
+}
+
+// BackoffFunc is a function type that returns the delay to wait after the given
+// 1-based attempt has failed and before the next attempt is made.
+type BackoffFunc func(attempt int) time.Duration
+
+// DelayFunc is a function type that returns how long to wait before the next
+// attempt. The attempt is the 1-based number of the attempt that just failed and
+// err is the error it returned.
+type DelayFunc func(attempt int, err error) time.Duration
+
+// DelayInterceptorFunc is a function type that receives the delay proposed for
+// the next attempt and returns the delay that should actually be used.
+type DelayInterceptorFunc func(attempt int, proposed time.Duration, err error) time.Duration
+
 // SimpleRetryPolicy is a RetryPolicy that retries the max attempts with no delay
-// between retries.
+// between retries. An attempts of 1 never retries.
+//
+// Attempts less than 1 will cause a panic, as will negative delays for any of
+// the built-in policies.
 func SimpleRetryPolicy(attempts int) RetryPolicy {
-	return func(err error) bool {
-		// If the error is from the context being canceled there is no reason
-		// to continue retrying
-		if errors.Is(err, context.Canceled) {
+	checkAttempts(attempts)
+	remaining := attempts
+	return builtinPolicy(func(c *consultation) bool {
+		if c.reset {
+			remaining = attempts
+		}
+		// If the error is from the context being canceled or its deadline
+		// passing there is no reason to continue retrying
+		if contextDone(c.err) {
 			return false
 		}
-		if attempts--; attempts > 0 {
+		if remaining--; remaining > 0 {
 			return true
 		}
 		return false
-	}
+	})
 }
 
 // FixedRetryPolicy returns a RetryPolicy that retries the max attempts delaying
 // the provided fixed duration between attempts.
 func FixedRetryPolicy(attempts int, delay time.Duration) RetryPolicy {
-	return func(err error) bool {
-		// If the error is from the context being canceled there is no reason
-		// to continue retrying
-		if errors.Is(err, context.Canceled) {
-			return false
-		}
-		if attempts--; attempts > 0 {
-			time.Sleep(delay)
-			return true
+	checkAttempts(attempts)
+	return BackoffRetryPolicy(WithMaxAttemptsBackoff(NewFixedBackoff(delay), attempts))
+}
+
+// PolicyOption configures the built-in RetryPolicy and Backoff implementations
+// that apply jitter to their delays.
+type PolicyOption func(p *policyConfig)
+
+type policyConfig struct {
+	rand       *rand.Rand
+	jitter     Jitter
+	multiplier float64
+}
+
+func newPolicyConfig(opts []PolicyOption) policyConfig {
+	cfg := policyConfig{
+		rand:       defaultRand,
+		multiplier: 2,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// jitterStrategy returns the Jitter configured using WithJitterStrategy or, by
+// default, +/- 25% jitter drawing from the configured source of randomness.
+func (p policyConfig) jitterStrategy() Jitter {
+	if p.jitter != nil {
+		return p.jitter
+	}
+	r := p.rand
+	return func(base time.Duration) time.Duration {
+		return jitter(r, base)
+	}
+}
+
+// WithRand sets the source of randomness used for jitter, which allows for
+// reproducible delays, for example in tests. A rand.Rand is not safe for
+// concurrent use, so r must not be shared with anything else running at the
+// same time. By default a source private to this package is used.
+//
+// A nil rand.Rand will cause a panic.
+func WithRand(r *rand.Rand) PolicyOption {
+	if r == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil Rand"))
+	}
+	return func(p *policyConfig) {
+		p.rand = r
+	}
+}
+
+// WithJitter enables or disables the jitter applied to the delays, which is
+// enabled by default. Without jitter the delays are exact, for example the nth
+// delay of ExponentialBackoffRetryPolicy is initialDelay * 2^(n-1), which makes
+// the schedule predictable, for example in tests. Jitter spreads out the retries
+// of clients that failed at the same time, so it should usually stay enabled in
+// production. WithJitter(false) is the same as WithJitterStrategy(NoJitter) and
+// WithJitter(true) restores the default jitter.
+func WithJitter(enabled bool) PolicyOption {
+	return func(p *policyConfig) {
+		p.jitter = nil
+		if !enabled {
+			p.jitter = NoJitter
 		}
-		return false
+	}
+}
+
+// Jitter is a function type that randomizes the delay computed by a policy,
+// returning the delay that is actually waited. base is the delay without jitter,
+// such as initialDelay * 2^(n-1) for the nth delay of
+// ExponentialBackoffRetryPolicy.
+type Jitter func(base time.Duration) time.Duration
+
+// WithJitterStrategy replaces the default +/- 25% jitter of the exponential,
+// linear and Fibonacci policies and Backoffs with j. As with the default, the
+// first delay of the exponential policies is not jittered. A deterministic
+// Jitter makes the delays predictable, for example in tests. Unlike the default
+// jitter, j does not draw from the source of randomness set using WithRand.
+//
+// A nil Jitter will cause a panic.
+func WithJitterStrategy(j Jitter) PolicyOption {
+	if j == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(p *policyConfig) {
+		p.jitter = j
+	}
+}
+
+// NoJitter is a Jitter returning the delay as is, so delays are exactly those
+// of the schedule.
+var NoJitter Jitter = func(base time.Duration) time.Duration {
+	return base
+}
+
+// FullJitter is a Jitter returning a random delay between 0 and base, which
+// spreads out retries the most but may retry almost immediately.
+var FullJitter Jitter = func(base time.Duration) time.Duration {
+	if base <= 0 {
+		return base
+	}
+	if base == math.MaxInt64 {
+		return time.Duration(defaultRand.Int63n(int64(base)))
+	}
+	return time.Duration(defaultRand.Int63n(int64(base) + 1))
+}
+
+// EqualJitter is a Jitter returning half of base plus a random delay between 0
+// and the other half, so the delay is always at least base/2.
+var EqualJitter Jitter = func(base time.Duration) time.Duration {
+	if base <= 0 {
+		return base
+	}
+	half := base / 2
+	return half + FullJitter(base-half)
+}
+
+// ProportionalJitter returns a Jitter randomly varying the delay by +/- fraction
+// of base, so ProportionalJitter(0.25) randomizes the delay like the default
+// jitter, though without drawing from the source of randomness set using
+// WithRand.
+//
+// A fraction less than 0 or greater than 1 will cause a panic.
+func ProportionalJitter(fraction float64) Jitter {
+	if !(fraction >= 0 && fraction <= 1) {
+		panic(fmt.Errorf("illegal use of api: jitter fraction must be between 0 and 1"))
+	}
+	return func(base time.Duration) time.Duration {
+		return proportionalJitter(defaultRand, base, fraction)
+	}
+}
+
+// WithMultiplier sets the factor the delays of the exponential policies and
+// Backoffs grow by after each attempt, instead of doubling. The nth delay is the
+// initial delay times factor^(n-1), jitter is applied to the result. Factors
+// below 2, such as 1.5, grow more gently, larger factors more steeply.
+//
+// A factor of 1 or less will cause a panic.
+func WithMultiplier(factor float64) PolicyOption {
+	if !(factor > 1) {
+		panic(fmt.Errorf("illegal use of api: multiplier must be greater than 1"))
+	}
+	return func(p *policyConfig) {
+		p.multiplier = factor
 	}
 }
 
 // ExponentialBackoffRetryPolicy is a RetryPolicy that retries the max attempts
 // with a delay between each retry. After each attempt the delay duration is doubled
-// +/- 25% jitter.
-func ExponentialBackoffRetryPolicy(attempts int, initialDelay time.Duration) RetryPolicy {
-	delay := initialDelay
+// +/- 25% jitter. WithMultiplier changes the factor the delay grows by and
+// WithJitter(false) removes the jitter. The delay grows without bound, use
+// CappedExponentialBackoffRetryPolicy to cap it.
+func ExponentialBackoffRetryPolicy(attempts int, initialDelay time.Duration, opts ...PolicyOption) RetryPolicy {
+	checkAttempts(attempts)
+	checkDelay(initialDelay)
+	cfg := newPolicyConfig(opts)
+	return BackoffRetryPolicy(WithMaxAttemptsBackoff(newExponentialBackoff(initialDelay, 0, cfg), attempts))
+}
+
+// CappedExponentialBackoffRetryPolicy is an ExponentialBackoffRetryPolicy whose
+// delay never exceeds maxDelay. The cap is applied after jitter, so once the
+// doubled delay reaches maxDelay every following retry waits exactly maxDelay.
+// A delay requested by an error implementing RetryAfterCarrier is not capped.
+func CappedExponentialBackoffRetryPolicy(attempts int, initialDelay, maxDelay time.Duration, opts ...PolicyOption) RetryPolicy {
+	checkAttempts(attempts)
+	checkDelay(initialDelay)
+	if maxDelay <= 0 {
+		panic(fmt.Errorf("illegal use of api: max delay must be greater than zero"))
+	}
+	cfg := newPolicyConfig(opts)
+	return BackoffRetryPolicy(WithMaxAttemptsBackoff(newExponentialBackoff(initialDelay, maxDelay, cfg), attempts))
+}
+
+// FibonacciBackoffRetryPolicy is a RetryPolicy that retries the max attempts
+// with delays growing along the Fibonacci sequence, the nth delay is fib(n)
+// times unit, so 1, 1, 2, 3, 5, 8, ... units, +/- 25% jitter. The delays grow
+// slower than those of ExponentialBackoffRetryPolicy. WithJitter(false) removes
+// the jitter.
+func FibonacciBackoffRetryPolicy(attempts int, unit time.Duration, opts ...PolicyOption) RetryPolicy {
+	checkAttempts(attempts)
+	checkDelay(unit)
+	cfg := newPolicyConfig(opts)
+	return BackoffRetryPolicy(WithMaxAttemptsBackoff(newFibonacciBackoff(unit, cfg), attempts))
+}
+
+// LinearRetryPolicy is a RetryPolicy that retries the max attempts with a delay
+// growing by increment after each retry, the nth delay is initialDelay plus n-1
+// times increment, +/- 25% jitter. The delays grow more gently than those of
+// ExponentialBackoffRetryPolicy, which suits rate-limited APIs. WithJitter(false)
+// removes the jitter.
+func LinearRetryPolicy(attempts int, initialDelay, increment time.Duration, opts ...PolicyOption) RetryPolicy {
+	checkAttempts(attempts)
+	checkDelay(initialDelay)
+	checkDelay(increment)
+	cfg := newPolicyConfig(opts)
+	return BackoffRetryPolicy(WithMaxAttemptsBackoff(newLinearBackoff(initialDelay, increment, cfg), attempts))
+}
+
+// SchedulePolicy is a RetryPolicy following a fixed schedule of delays, such as
+// 100ms, 1s, 5s and 30s, for schedules that don't fit a formula. It retries once
+// for every delay, so the operation is attempted len(delays)+1 times, waiting
+// the nth delay after the nth attempt failed. No jitter is applied. Without
+// delays it never retries.
+func SchedulePolicy(delays ...time.Duration) RetryPolicy {
+	for _, d := range delays {
+		checkDelay(d)
+	}
+	return BackoffRetryPolicy(&scheduleBackoff{delays: append([]time.Duration(nil), delays...)})
+}
+
+// checkAttempts panics if attempts is not a valid number of attempts for one of
+// the built-in policies.
+func checkAttempts(attempts int) {
+	if attempts < 1 {
+		panic(fmt.Errorf("illegal use of api: attempts must be at least 1"))
+	}
+}
+
+// checkDelay panics if d is not a valid delay for one of the built-in policies.
+func checkDelay(d time.Duration) {
+	if d < 0 {
+		panic(fmt.Errorf("illegal use of api: delay cannot be negative"))
+	}
+}
+
+// consultation is the error Retry consults the RetryPolicy with after an
+// attempt failed. It wraps the error of the attempt and tells the built-in
+// policies to reset the state kept for a previous operation at the first
+// consultation of an operation, or to restore their initial delay as requested
+// using WithResetOn. Instead of sleeping, the built-in policies store the delay
+// before the next attempt in it, so Retry can wait the delay itself.
+type consultation struct {
+	err        error
+	reset      bool
+	resetDelay bool
+	delay      time.Duration
+}
+
+func (c *consultation) Error() string {
+	return c.err.Error()
+}
+
+func (c *consultation) Unwrap() error {
+	return c.err
+}
+
+// builtinPolicy returns a RetryPolicy deciding using decide. Consulted with an
+// error wrapping a consultation, it stores its delay in the consultation. With
+// any other error, for example when invoked directly instead of by Retry, it
+// sleeps before returning like any other RetryPolicy.
+func builtinPolicy(decide func(c *consultation) bool) RetryPolicy {
 	return func(err error) bool {
-		// If the error is from the context being canceled there is no reason
-		// to continue retrying
-		if errors.Is(err, context.Canceled) {
+		var c *consultation
+		if errors.As(err, &c) {
+			return decide(c)
+		}
+		if err == nil {
+			return false
+		}
+		c = &consultation{err: err}
+		if !decide(c) {
+			return false
+		}
+		if d := retryAfter(err, c.delay); d > 0 {
+			time.Sleep(d)
+		}
+		return true
+	}
+}
+
+// addDelay returns a+b, saturating instead of overflowing.
+func addDelay(a, b time.Duration) time.Duration {
+	if b > 0 && a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// WeightedRetryPolicy is a RetryPolicy that assigns each error a weight using the
+// provided weigh function and stops retrying once the accumulated weight of all
+// errors reaches the threshold. Heavier errors exhaust the policy faster than
+// lighter ones. After each attempt that is retried Retry waits the delay
+// returned by backoff, a nil backoff retries without delay.
+func WeightedRetryPolicy(threshold float64, weigh func(error) float64, backoff BackoffFunc) RetryPolicy {
+	if weigh == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	var total float64
+	attempt := 0
+	return builtinPolicy(func(c *consultation) bool {
+		if c.reset {
+			total, attempt = 0, 0
+		}
+		// The delays start over but the accumulated weight is kept
+		if c.resetDelay {
+			attempt = 0
+		}
+		// If the error is from the context being canceled or its deadline
+		// passing there is no reason to continue retrying
+		if contextDone(c.err) {
 			return false
 		}
-		if attempts--; attempts > 0 {
-			time.Sleep(delay)
-			delay = exponential(delay)
+		attempt++
+		if total += weigh(c.err); total < threshold {
+			var delay time.Duration
+			if backoff != nil {
+				delay = backoff(attempt)
+			}
+			c.delay = delay
 			return true
 		}
 		return false
-	}
+	})
 }
 
 // Option allows additional configuration of the retries.
@@ -99,59 +482,1332 @@ func ErrorHook(fn OnErrorFunc) Option {
 	}
 }
 
-// Retry invokes a Retryable and retries according to the provided RetryPolicy.
-// Once all attempts have been exhausted this function will return an
-// UnrecoverableError.
+// OnGiveUp adds a callback invoked once when Retry gives up, immediately before
+// it returns the UnrecoverableError, with the number of attempts made and the
+// error that made Retry give up. It is not invoked if the operation succeeds,
+// the context is done or retrying is stopped with Permanent or RetryIf, which
+// makes it a clean signal for alerting on exhausted retries.
+func OnGiveUp(fn func(attempts int, finalErr error)) Option {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.onGiveUp = fn
+	}
+}
+
+// OnSuccess adds a callback invoked once when an attempt succeeds, with the
+// number of attempts made and the time elapsed since the first attempt started,
+// excluding the delay configured using WithInitialDelay. Paired with OnGiveUp it
+// records both the operations that recovered after retries and those that
+// failed for good.
+func OnSuccess(fn func(attempts int, elapsed time.Duration)) Option {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.onSuccess = fn
+	}
+}
+
+// RetryIf sets a classifier deciding if an error is worth retrying at all. It is
+// consulted after every failed attempt before the RetryPolicy, if it returns
+// false Retry stops immediately and returns an AbandonedError wrapping the
+// error, without consulting the RetryPolicy. This separates which errors are
+// retried from how often and how long to wait, which remains up to the
+// RetryPolicy.
+func RetryIf(retryable func(error) bool) Option {
+	if retryable == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.retryIf = retryable
+	}
+}
+
+// AbortIf sets a classifier recognizing fatal errors, the inverse of RetryIf. If
+// it returns true for the error of a failed attempt Retry stops immediately and
+// returns an AbandonedError wrapping the error, without consulting the
+// RetryPolicy. It may be combined with RetryIf, an error is only retried if
+// RetryIf accepts it and AbortIf doesn't.
+func AbortIf(fatal func(error) bool) Option {
+	if fatal == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.abortIf = fatal
+	}
+}
+
+// OnRetry adds a callback invoked after a failed attempt once it is known that
+// it will be retried, with the 1-based number of the attempt that failed, its
+// error and the delay Retry waits before the next attempt. The delay includes
+// the delays of the built-in policies, such as those of FixedRetryPolicy, and
+// any delay configured using WithDelayFunc.
+func OnRetry(fn func(attempt int, err error, nextDelay time.Duration)) Option {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.onRetry = fn
+	}
+}
+
+// WithLogger configures Retry to log a line through l whenever a failed attempt
+// is retried, including the number of the attempt, its error and the delay
+// before the next attempt as reported to OnRetry, and when it gives up, which
+// provides sensible retry logs without wiring up hooks.
 //
-// A zero-value/nil RetryPolicy or Retryable will cause a panic.
-func Retry(policy RetryPolicy, fn Retryable, opts ...Option) error {
-	if policy == nil {
-		panic(fmt.Errorf("illegal use of api: cannot operate on nil RetryPolicy"))
+// A nil Logger will cause a panic.
+func WithLogger(l Logger) Option {
+	if l == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil Logger"))
+	}
+	return func(r *retry) {
+		r.logger = l
 	}
+}
+
+// WithDelayFunc configures Retry to wait the duration returned by fn after a
+// failed attempt before the next attempt is made. The delay is added to the
+// delay of the RetryPolicy once it has agreed to retry, pairing WithDelayFunc
+// with SimpleRetryPolicy makes it the only delay.
+//
+// As fn receives the error, the delay can depend on the kind of failure, for
+// example waiting only for errors signalling backpressure and retrying other
+// errors immediately by returning zero.
+func WithDelayFunc(fn DelayFunc) Option {
 	if fn == nil {
 		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
 	}
-	r := &retry{
-		fn:     fn,
-		policy: policy,
+	return func(r *retry) {
+		r.delay = fn
 	}
+}
 
-	for _, opt := range opts {
-		opt(r)
+// WithDelayInterceptor adds a callback that is invoked with the delay proposed
+// for the next attempt, after it has been computed and before Retry waits. The
+// duration returned by fn is used instead, and negative values are treated as
+// zero. Unlike WithDelayFunc, which adds to the delay of the RetryPolicy, the
+// interceptor transforms the whole delay, which allows adjusting delays at
+// runtime, for example based on current backpressure.
+func WithDelayInterceptor(fn DelayInterceptorFunc) Option {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.interceptDelay = fn
 	}
-	return r.do()
 }
 
-type retry struct {
-	policy  RetryPolicy
-	fn      Retryable
-	onError OnErrorFunc
+// WithContext makes Retry aware of ctx. Before each attempt Retry checks if ctx is
+// done, and the waits performed by Retry, such as those configured with
+// WithDelayFunc or WithInitialDelay and the delays of the built-in policies,
+// return as soon as ctx is done. In all cases Retry returns the error of the
+// context. See RetryContext.
+//
+// As Retry waits the delays of the existing constructors such as
+// ExponentialBackoffRetryPolicy itself, adding WithContext to an existing call
+// is enough to make its backoff cancellable. A RetryPolicy implemented by other
+// means that sleeps before returning is not interrupted, Retry returns the
+// error of the context once the policy returns.
+func WithContext(ctx context.Context) Option {
+	if ctx == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil Context"))
+	}
+	return func(r *retry) {
+		r.ctx = ctx
+	}
 }
 
-func (r retry) do() error {
-	if err := r.fn(); err != nil {
-		if r.onError != nil {
-			r.onError(err)
-		}
-		if r.policy(err) {
-			return r.do()
-		}
-		return UnrecoverableError{Err: err}
+// WithContextErrorMatcher customizes how Retry recognizes errors caused by
+// cancellation when a context has been configured with WithContext. If an
+// attempt fails with an error for which match returns true Retry stops without
+// consulting the RetryPolicy and returns an AbandonedError. This accommodates
+// frameworks with their own cancellation errors that don't wrap the errors of
+// the context package. By default, errors matching context.Canceled or
+// context.DeadlineExceeded are recognized.
+func WithContextErrorMatcher(match func(error) bool) Option {
+	if match == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.isContextErr = match
 	}
-	return nil
 }
 
-type UnrecoverableError struct {
-	Err error
+// WithPerAttemptTimeout bounds every attempt of RetryCtx, Retrier.DoCtx and
+// RunWithRetry to d. Each attempt receives a context derived from the context of
+// the operation that is done after d. An attempt that fails once its context
+// timed out counts as a failed attempt like any other, the
+// context.DeadlineExceeded error it returns is passed to the hooks and the
+// RetryPolicy and may be retried. Because the context of an attempt is derived
+// from the context of the operation, an attempt never outlives it, once the
+// deadline of the operation passes Retry stops regardless of d. The option has
+// no effect on operations that don't accept a context.
+func WithPerAttemptTimeout(d time.Duration) Option {
+	return func(r *retry) {
+		r.attemptTimeout = d
+	}
 }
 
-func (u UnrecoverableError) Error() string {
-	return fmt.Sprintf("max retries exceeded: %s", u.Err)
+// WithInitialDelay delays the first attempt by d. Unlike the delays between
+// attempts this wait happens before fn is invoked at all, which is useful when a
+// dependency needs time to become available. Combined with WithContext, or when
+// used with RetryContext or RetryCtx, the wait is aborted when the context is
+// done.
+func WithInitialDelay(d time.Duration) Option {
+	return func(r *retry) {
+		r.initialDelay = d
+	}
 }
 
-func exponential(d time.Duration) time.Duration {
-	d *= 2
-	jitter := rand.Float64() + 0.25
-	d = time.Duration(int64(float64(d.Nanoseconds()) * jitter))
-	return d
+// WithMaxElapsedTime stops retrying once d has passed since the first attempt,
+// regardless of the RetryPolicy, returning an UnrecoverableError. It is checked
+// after every failed attempt, and Retry also gives up right away if waiting
+// the delay before the next attempt, including the delay of a built-in policy,
+// would exceed d. A d of zero or less disables the limit.
+func WithMaxElapsedTime(d time.Duration) Option {
+	return func(r *retry) {
+		r.maxElapsed = d
+	}
+}
+
+// WithMaxAttempts caps the total number of attempts at n, counting the initial
+// attempt, regardless of the RetryPolicy. Once n attempts have failed Retry
+// gives up and returns an UnrecoverableError without consulting the RetryPolicy,
+// which guards against policies configured with an excessive number of
+// attempts.
+//
+// A n less than 1 will cause a panic.
+func WithMaxAttempts(n int) Option {
+	checkAttempts(n)
+	return func(r *retry) {
+		r.maxAttempts = n
+	}
+}
+
+// WithResetOn makes the delays of the RetryPolicy start over when the error of
+// an attempt differs from the error of the previous attempt in a way that
+// matters, so a new failure mode doesn't inherit the long delay grown by the
+// previous one. After every failed attempt but the first, reset is invoked with
+// the previous and the current error before the RetryPolicy is consulted. If it
+// returns true the built-in policies restore their initial delay, the attempts
+// made so far still count towards the limit of the policy. Other RetryPolicy
+// implementations and delays configured using WithDelayFunc are not affected.
+//
+// A nil function will cause a panic.
+func WithResetOn(reset func(prev, cur error) bool) Option {
+	if reset == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.resetOn = reset
+	}
+}
+
+// WithStopOnRepeatedError stops retrying once n consecutive attempts failed with
+// the same error, regardless of the RetryPolicy, returning an UnrecoverableError.
+// An error repeating that often usually indicates a permanent fault such as a
+// misconfiguration rather than a transient one. Errors are the same if they
+// match according to errors.Is or have the same message, a different error
+// starts counting over.
+//
+// A n less than 2 will cause a panic.
+func WithStopOnRepeatedError(n int) Option {
+	if n < 2 {
+		panic(fmt.Errorf("illegal use of api: repeated error limit must be at least 2"))
+	}
+	return func(r *retry) {
+		r.repeatLimit = n
+	}
+}
+
+// WithDeadline stops retrying once t has passed, regardless of the RetryPolicy,
+// returning an UnrecoverableError. Like WithMaxElapsedTime it is checked after
+// every failed attempt. If the delay before the next attempt, including the
+// delay of a built-in policy, would end past t Retry gives up right away
+// instead of sleeping past the deadline. A zero t disables the deadline.
+func WithDeadline(t time.Time) Option {
+	return func(r *retry) {
+		r.deadline = t
+	}
+}
+
+// WithMaxDelay caps the delays Retry waits between attempts at max, including
+// the delays of the built-in policies, after the DelayFunc and any
+// DelayInterceptorFunc have been applied. A max of zero or less disables the
+// cap.
+func WithMaxDelay(max time.Duration) Option {
+	return func(r *retry) {
+		r.maxDelay = max
+	}
+}
+
+// WithCapWarning invokes warn once during an operation when the delay between
+// attempts has been capped by WithMaxDelay threshold times, with the number of
+// attempts made so far. Repeatedly hitting the cap indicates the dependency
+// being retried is badly unhealthy, which is usually worth alerting on.
+//
+// A threshold less than 1 or a nil function will cause a panic.
+func WithCapWarning(threshold int, warn func(attempts int)) Option {
+	if threshold < 1 {
+		panic(fmt.Errorf("illegal use of api: cap warning threshold must be at least 1"))
+	}
+	if warn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.capThreshold = threshold
+		r.warnCap = warn
+	}
+}
+
+// WithSuppressFinalErrorHook prevents the ErrorHook from being invoked for the
+// attempt after which Retry gives up, so the hook only observes errors that are
+// going to be retried. This separates logging of transient failures from
+// handling the final failure, which is returned by Retry. Because Retry has to
+// know whether it will retry before invoking the hook, the hook is invoked after
+// the RetryPolicy has been consulted, though still before the delay before the
+// next attempt.
+func WithSuppressFinalErrorHook() Option {
+	return func(r *retry) {
+		r.suppressFinalErrorHook = true
+	}
+}
+
+// WithOnAuthError handles the common case of an attempt failing because
+// credentials expired. If an attempt fails with an error for which match returns
+// true, and the attempt is going to be retried, refresh is invoked right before
+// the next attempt so it can obtain new credentials. If refresh returns an error
+// Retry gives up with that error.
+func WithOnAuthError(match func(error) bool, refresh func() error) Option {
+	if match == nil || refresh == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.isAuthErr = match
+		r.refreshAuth = refresh
+	}
+}
+
+// WithIdempotencyCheck guards operations that must not be repeated, such as
+// payments, against attempts that completed despite failing, for example
+// because the response timed out. The check runs after every failed attempt,
+// before the RetryPolicy is consulted and before any delay before the next
+// attempt. If it reports that the operation is done Retry stops and returns nil.
+// If the check itself fails it is not safe to retry, so Retry gives up with that
+// error. A typical check looks up an idempotency key or the state of a
+// downstream record.
+func WithIdempotencyCheck(check func() (done bool, err error)) Option {
+	if check == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.checkDone = check
+	}
+}
+
+// WithAttemptHistogram adds a callback that is invoked exactly once per
+// operation, when Retry returns, with the total number of attempts that were
+// made, whether the operation succeeded or not. Feeding the count into a
+// histogram shows how many attempts operations typically need. If the context
+// configured with WithContext is done before the first attempt the count is
+// zero.
+func WithAttemptHistogram(observe func(attempts int)) Option {
+	if observe == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.observeAttempts = observe
+	}
+}
+
+// WithObserver invokes fn after every attempt, successful or not, with the
+// 1-based number of the attempt, the time spent in the Retryable and the error
+// it returned, nil on success. Unlike OnRetry it also observes the final
+// attempt, which makes it suitable for recording the latency of attempts.
+func WithObserver(fn func(attempt int, duration time.Duration, err error)) Option {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return func(r *retry) {
+		r.observe = fn
+	}
+}
+
+// WithAttemptContext annotates the error of every failed attempt with the
+// number of the attempt that produced it, as in "attempt 2: connection refused".
+// The annotated error is what hooks, the RetryPolicy and the UnrecoverableError
+// returned by Retry observe. The original error is wrapped, so errors.Is and
+// errors.As still reach it.
+func WithAttemptContext() Option {
+	return func(r *retry) {
+		r.annotateErrors = true
+	}
+}
+
+// WithRecover recovers panics of the Retryable and treats them like errors, so
+// they are passed to the hooks and the RetryPolicy and may be retried. The error
+// holds the recovered value and the stack trace of the panic in its message, if
+// the recovered value is an error it is wrapped.
+func WithRecover() Option {
+	return func(r *retry) {
+		r.recoverPanics = true
+	}
+}
+
+// WithoutWrap makes Retry return the error of the final attempt as is once it
+// gives up, instead of wrapping it in an UnrecoverableError or AbandonedError.
+// Errors collected using CollectErrors are not available in that case.
+func WithoutWrap() Option {
+	return func(r *retry) {
+		r.withoutWrap = true
+	}
+}
+
+// CollectErrors configures Retry to keep the error of every failed attempt. When
+// retries are exhausted the errors are available, oldest first, in the Errs field
+// of the returned UnrecoverableError, which unwraps to all of them like an error
+// created with errors.Join, so errors.Is and errors.As match any of them.
+func CollectErrors() Option {
+	return func(r *retry) {
+		r.collectErrors = true
+	}
+}
+
+// WithErrorHistoryLimit bounds the memory used to collect errors by keeping only
+// the n most recent errors, older errors are dropped and only counted. It
+// implies CollectErrors.
+//
+// A limit less than 1 will cause a panic.
+func WithErrorHistoryLimit(n int) Option {
+	if n < 1 {
+		panic(fmt.Errorf("illegal use of api: error history limit must be at least 1"))
+	}
+	return func(r *retry) {
+		r.collectErrors = true
+		r.historyLimit = n
+	}
+}
+
+// RetryContext is like Retry but stops retrying as soon as ctx is done. The
+// context is checked before each attempt, and any delay between attempts,
+// including the delays of the built-in policies such as FixedRetryPolicy and
+// ExponentialBackoffRetryPolicy, is abandoned once the context is done. In that
+// case the error of the context is returned and fn is not invoked again. It is
+// equivalent to passing WithContext(ctx) to Retry.
+//
+// A nil Context, RetryPolicy or Retryable will cause a panic.
+func RetryContext(ctx context.Context, policy RetryPolicy, fn Retryable, opts ...Option) error {
+	return Retry(policy, fn, append(opts[:len(opts):len(opts)], WithContext(ctx))...)
+}
+
+// RetryCtx is like RetryContext but passes ctx to every invocation of fn, so
+// the operation itself can observe cancellation, for example by using ctx for
+// HTTP requests or database queries.
+//
+// A nil Context, RetryPolicy or RetryableCtx will cause a panic.
+func RetryCtx(ctx context.Context, policy RetryPolicy, fn RetryableCtx, opts ...Option) error {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	_, err := retryN(policy, nil, fn, append(opts[:len(opts):len(opts)], WithContext(ctx)))
+	return err
+}
+
+// Retry invokes a Retryable and retries according to the provided RetryPolicy.
+// Once all attempts have been exhausted this function will return an
+// UnrecoverableError.
+//
+// A zero-value/nil RetryPolicy or Retryable will cause a panic.
+func Retry(policy RetryPolicy, fn Retryable, opts ...Option) error {
+	_, err := RetryN(policy, fn, opts...)
+	return err
+}
+
+// RetryN is like Retry but also returns the number of times fn was invoked,
+// counting the initial attempt, whether it eventually succeeded or not.
+//
+// A zero-value/nil RetryPolicy or Retryable will cause a panic.
+func RetryN(policy RetryPolicy, fn Retryable, opts ...Option) (attempts int, err error) {
+	if policy == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil RetryPolicy"))
+	}
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return retryN(policy, fn, nil, opts)
+}
+
+// RetryResult describes the outcome of an operation retried by RetryDetailed.
+type RetryResult struct {
+	// Attempts is the number of times the operation was invoked, counting the
+	// initial attempt.
+	Attempts int
+	// TotalDuration is the time spent retrying the operation, including any
+	// delays between attempts.
+	TotalDuration time.Duration
+	// Errors holds the error of every failed attempt, oldest first.
+	Errors []error
+	// Succeeded reports if an attempt eventually succeeded.
+	Succeeded bool
+}
+
+// RetryDetailed is like Retry but also returns a RetryResult describing every
+// attempt, which provides everything needed for logging and metrics without
+// registering hooks. The errors in the RetryResult are kept regardless of
+// CollectErrors and WithErrorHistoryLimit.
+//
+// A zero-value/nil RetryPolicy or Retryable will cause a panic.
+func RetryDetailed(policy RetryPolicy, fn Retryable, opts ...Option) (RetryResult, error) {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	var result RetryResult
+	start := time.Now()
+	attempts, err := retryN(policy, fn, nil, append(opts[:len(opts):len(opts)], func(r *retry) {
+		r.result = &result
+	}))
+	result.Attempts = attempts
+	result.TotalDuration = time.Since(start)
+	result.Succeeded = err == nil
+	return result, err
+}
+
+// retryN implements RetryN and RetryCtx, exactly one of fn and fnCtx is set.
+func retryN(policy RetryPolicy, fn Retryable, fnCtx RetryableCtx, opts []Option) (int, error) {
+	if policy == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil RetryPolicy"))
+	}
+	r := retryPool.Get().(*retry)
+	defer r.release()
+	*r = retry{
+		fn:           fn,
+		fnCtx:        fnCtx,
+		policy:       policy,
+		isContextErr: isContextErr,
+		errs:         r.errs[:0],
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+	err := r.run()
+	return r.attempts, err
+}
+
+// RunWithRetry runs fn until ctx is done, restarting it whenever it returns. It
+// is intended for supervisor loops of long-running work such as consumers or
+// connections that need to be re-established. After fn fails RunWithRetry waits
+// the delay returned by backoff for the number of consecutive failures before
+// restarting it. When fn returns nil it is restarted immediately and the backoff
+// starts over, so a single success resets the delays. The provided Options, such
+// as ErrorHook, apply to every failure.
+//
+// RunWithRetry returns the error of ctx once it is done. It only returns
+// earlier if one of the Options gives up, for example because WithOnAuthError
+// failed to refresh credentials.
+//
+// A nil fn or backoff will cause a panic.
+func RunWithRetry(ctx context.Context, fn RetryableCtx, backoff BackoffFunc, opts ...Option) error {
+	if fn == nil || backoff == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	opts = append(opts[:len(opts):len(opts)], WithContext(ctx), WithDelayFunc(func(attempt int, err error) time.Duration {
+		return backoff(attempt)
+	}))
+	for {
+		_, err := retryN(retryForever, nil, fn, opts)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// retryForever is a RetryPolicy that never gives up.
+func retryForever(error) bool {
+	return true
+}
+
+// RetryWithResource retries an operation that needs a resource, such as a
+// connection or transaction, for each attempt. Every attempt acquires the
+// resource, passes it to use and releases it again. An attempt fails if either
+// acquire or use returns an error, in which case it is retried according to the
+// RetryPolicy. release is invoked exactly once for every resource that was
+// acquired successfully, regardless of the outcome of use, so resources are not
+// leaked across attempts.
+//
+// A zero-value/nil RetryPolicy, acquire, use or release will cause a panic.
+func RetryWithResource[R any](policy RetryPolicy, acquire func() (R, error), use func(R) error, release func(R), opts ...Option) error {
+	if acquire == nil || use == nil || release == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	return Retry(policy, func() error {
+		resource, err := acquire()
+		if err != nil {
+			return err
+		}
+		defer release(resource)
+		return use(resource)
+	}, opts...)
+}
+
+// RetryWithAttempt is like Retry but passes the 1-based number of the attempt to
+// every invocation of fn, so fn can adjust its behavior on retries without
+// keeping count itself, for example by switching to another replica or reducing
+// the size of a batch.
+//
+// A zero-value/nil RetryPolicy or RetryableAttempt will cause a panic.
+func RetryWithAttempt(policy RetryPolicy, fn RetryableAttempt, opts ...Option) error {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	attempt := 0
+	return Retry(policy, func() error {
+		attempt++
+		return fn(attempt)
+	}, opts...)
+}
+
+// RetryWithResult invokes a function returning a value and an error and retries
+// it according to the provided RetryPolicy, the same as Retry. The value of the
+// successful attempt is returned. If retries are exhausted the zero value is
+// returned along with the error. This saves assigning the result to a variable
+// captured by a Retryable.
+//
+// A zero-value/nil RetryPolicy or function will cause a panic.
+func RetryWithResult[T any](policy RetryPolicy, fn func() (T, error), opts ...Option) (T, error) {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	var result T
+	err := Retry(policy, func() error {
+		res, err := fn()
+		if err != nil {
+			return err
+		}
+		result = res
+		return nil
+	}, opts...)
+	return result, err
+}
+
+// RetryWithResult2 invokes a function returning two values and an error and
+// retries it according to the provided RetryPolicy, the same as Retry. The
+// values of the successful attempt are returned. If retries are exhausted the
+// zero values are returned along with the error.
+//
+// A zero-value/nil RetryPolicy or function will cause a panic.
+func RetryWithResult2[A, B any](policy RetryPolicy, fn func() (A, B, error), opts ...Option) (A, B, error) {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	var a A
+	var b B
+	err := Retry(policy, func() error {
+		resA, resB, err := fn()
+		if err != nil {
+			return err
+		}
+		a, b = resA, resB
+		return nil
+	}, opts...)
+	return a, b, err
+}
+
+// RetryWithResult3 invokes a function returning three values and an error and
+// retries it according to the provided RetryPolicy, the same as Retry. The
+// values of the successful attempt are returned. If retries are exhausted the
+// zero values are returned along with the error.
+//
+// A zero-value/nil RetryPolicy or function will cause a panic.
+func RetryWithResult3[A, B, C any](policy RetryPolicy, fn func() (A, B, C, error), opts ...Option) (A, B, C, error) {
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	var a A
+	var b B
+	var c C
+	err := Retry(policy, func() error {
+		resA, resB, resC, err := fn()
+		if err != nil {
+			return err
+		}
+		a, b, c = resA, resB, resC
+		return nil
+	}, opts...)
+	return a, b, c, err
+}
+
+// retryPool holds retry values for reuse across calls to Retry, which avoids
+// allocating the executor state for every operation.
+var retryPool = sync.Pool{
+	New: func() any {
+		return new(retry)
+	},
+}
+
+type retry struct {
+	policy                 RetryPolicy
+	retryIf                func(error) bool
+	abortIf                func(error) bool
+	fn                     Retryable
+	fnCtx                  RetryableCtx
+	attemptTimeout         time.Duration
+	attemptTimedOut        bool
+	recoverPanics          bool
+	onError                OnErrorFunc
+	onRetry                func(attempt int, err error, nextDelay time.Duration)
+	onGiveUp               func(attempts int, finalErr error)
+	onSuccess              func(attempts int, elapsed time.Duration)
+	logger                 Logger
+	suppressFinalErrorHook bool
+	delay                  DelayFunc
+	interceptDelay         DelayInterceptorFunc
+	ctx                    context.Context
+	isContextErr           func(error) bool
+	initialDelay           time.Duration
+	maxDelay               time.Duration
+	maxElapsed             time.Duration
+	deadline               time.Time
+	maxAttempts            int
+	repeatLimit            int
+	lastErr                error
+	repeats                int
+	budget                 *RetryBudget
+	resetOn                func(prev, cur error) bool
+	prevErr                error
+	first                  error
+	statusCodes            []int
+	start                  time.Time
+	capThreshold           int
+	warnCap                func(attempts int)
+	capped                 int
+	isAuthErr              func(error) bool
+	refreshAuth            func() error
+	checkDone              func() (bool, error)
+	observeAttempts        func(attempts int)
+	observe                func(attempt int, duration time.Duration, err error)
+	annotateErrors         bool
+	consulted              bool
+	maxGoroutines          int
+	withoutWrap            bool
+	collectErrors          bool
+	historyLimit           int
+	errs                   []error
+	dropped                int
+	attempts               int
+	result                 *RetryResult
+}
+
+// run performs the initial delay and all attempts and reports the outcome to the
+// hooks observing the operation as a whole.
+func (r *retry) run() error {
+	err := r.sleep(r.initialDelay)
+	if err == nil {
+		r.start = time.Now()
+		err = r.do()
+	}
+	if r.observeAttempts != nil {
+		r.observeAttempts(r.attempts)
+	}
+	return err
+}
+
+// do makes attempts until one succeeds or Retry stops retrying.
+func (r *retry) do() error {
+	for attempt := 1; ; attempt++ {
+		if r.ctx != nil {
+			if err := r.ctx.Err(); err != nil {
+				return err
+			}
+		}
+		r.attempts = attempt
+		err := r.attempt(attempt)
+		if err == nil {
+			if r.onSuccess != nil {
+				r.onSuccess(attempt, time.Since(r.start))
+			}
+			return nil
+		}
+		if r.onError != nil && !r.suppressFinalErrorHook {
+			r.onError(err)
+		}
+		r.record(err)
+		if r.checkDone != nil {
+			done, checkErr := r.checkDone()
+			if checkErr != nil {
+				return r.giveUp(checkErr)
+			}
+			if done {
+				return nil
+			}
+		}
+		delay, stopErr := r.next(attempt, err)
+		if stopErr != nil {
+			return stopErr
+		}
+		if r.onError != nil && r.suppressFinalErrorHook {
+			r.onError(err)
+		}
+		if r.onRetry != nil {
+			r.onRetry(attempt, err, delay)
+		}
+		if r.logger != nil {
+			r.logger.Logf("riprovare: attempt %d failed, retrying in %s: %v", attempt, delay, err)
+		}
+		if sleepErr := r.sleep(delay); sleepErr != nil {
+			return sleepErr
+		}
+		if r.isAuthErr != nil && r.isAuthErr(err) {
+			if refreshErr := r.refreshAuth(); refreshErr != nil {
+				return r.giveUp(refreshErr)
+			}
+		}
+	}
+}
+
+// attempt makes the nth attempt, annotating and observing its outcome.
+func (r *retry) attempt(n int) error {
+	var start time.Time
+	if r.observe != nil {
+		start = time.Now()
+	}
+	err := r.call()
+	if r.repeatLimit > 0 {
+		r.countRepeats(err)
+	}
+	if err != nil && r.annotateErrors {
+		err = fmt.Errorf("attempt %d: %w", n, err)
+	}
+	if r.observe != nil {
+		r.observe(n, time.Since(start), err)
+	}
+	return err
+}
+
+// countRepeats counts how many consecutive attempts failed with err. It is
+// called before errors are annotated with the attempt, which would make every
+// error unique.
+func (r *retry) countRepeats(err error) {
+	if err != nil && r.lastErr != nil && (errors.Is(err, r.lastErr) || err.Error() == r.lastErr.Error()) {
+		r.repeats++
+	} else {
+		r.repeats = 1
+	}
+	r.lastErr = err
+}
+
+// call invokes fn, or fnCtx with the context of the attempt. If panics are
+// recovered a panic is returned as an error holding the recovered value and the
+// stack of the goroutine.
+func (r *retry) call() (err error) {
+	if r.recoverPanics {
+		defer func() {
+			if v := recover(); v != nil {
+				if e, ok := v.(error); ok {
+					err = fmt.Errorf("panic: %w\n%s", e, debug.Stack())
+				} else {
+					err = fmt.Errorf("panic: %v\n%s", v, debug.Stack())
+				}
+			}
+		}()
+	}
+	if r.fnCtx == nil {
+		return r.fn()
+	}
+	if r.attemptTimeout <= 0 {
+		return r.fnCtx(r.ctx)
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, r.attemptTimeout)
+	defer cancel()
+	err = r.fnCtx(ctx)
+	// Only the attempt timed out, the operation as a whole may be retried
+	r.attemptTimedOut = err != nil && ctx.Err() == context.DeadlineExceeded && r.ctx.Err() == nil
+	if r.attemptTimedOut {
+		err = attemptTimeoutError{err: err}
+	}
+	return err
+}
+
+// next decides if the attempt that failed with err should be retried and
+// returns how long Retry waits before the next attempt. If it should not
+// be retried the error Retry returns is returned instead.
+func (r *retry) next(attempt int, err error) (time.Duration, error) {
+	var permanent permanentError
+	if errors.As(err, &permanent) {
+		return 0, permanent.err
+	}
+	if r.retryIf != nil && !r.retryIf(err) || r.abortIf != nil && r.abortIf(err) {
+		return 0, r.abandon(ReasonNotRetryable, err)
+	}
+	if r.ctx != nil && !r.attemptTimedOut && r.isContextErr(err) {
+		return 0, r.abandon(ReasonCanceled, err)
+	}
+	deadline, hasDeadline := retryDeadline(err)
+	if hasDeadline && !time.Now().Before(deadline) {
+		return 0, r.giveUp(err)
+	}
+	if r.maxAttempts > 0 && attempt >= r.maxAttempts {
+		return 0, r.giveUp(err)
+	}
+	if r.elapsedExceeded(0) || r.repeatLimit > 0 && r.repeats >= r.repeatLimit {
+		return 0, r.giveUp(err)
+	}
+	var resetDelay bool
+	if r.resetOn != nil {
+		resetDelay = r.prevErr != nil && r.resetOn(r.prevErr, err)
+		r.prevErr = err
+	}
+	if r.budget != nil && !r.budget.withdraw() {
+		return 0, r.giveUp(err)
+	}
+	delay, err := r.retryDelay(attempt, err, resetDelay)
+	// The token is only spent if the attempt is actually retried
+	if err != nil && r.budget != nil {
+		r.budget.deposit()
+	}
+	return delay, err
+}
+
+// retryDelay consults the RetryPolicy for the attempt that failed with err and
+// returns the delay before the next attempt, or the error Retry returns if the
+// attempt is not retried.
+func (r *retry) retryDelay(attempt int, err error, resetDelay bool) (time.Duration, error) {
+	ok, policyDelay := r.consult(err, resetDelay)
+	// A policy other than the built-in ones may have slept until ctx was done
+	if r.ctx != nil {
+		if ctxErr := r.ctx.Err(); ctxErr != nil {
+			return 0, ctxErr
+		}
+	}
+	if !ok {
+		// The built-in policies decline errors caused by cancellation, which
+		// doesn't mean the retries have been exhausted
+		if contextDone(err) {
+			return 0, r.abandon(ReasonCanceled, err)
+		}
+		return 0, r.giveUp(err)
+	}
+	delay := r.nextDelay(attempt, err, policyDelay)
+	if deadline, ok := retryDeadline(err); ok && time.Now().Add(delay).After(deadline) {
+		return 0, r.giveUp(err)
+	}
+	// Checked again for the delay, which must not end past the time limits
+	if r.elapsedExceeded(delay) {
+		return 0, r.giveUp(err)
+	}
+	return delay, nil
+}
+
+// elapsedExceeded reports if waiting another d before the next attempt would
+// exceed the time limit set with WithMaxElapsedTime or the deadline set with
+// WithDeadline.
+func (r *retry) elapsedExceeded(d time.Duration) bool {
+	if !r.deadline.IsZero() && time.Now().Add(d).After(r.deadline) {
+		return true
+	}
+	// Compared without adding to d, which may be as long as math.MaxInt64
+	return r.maxElapsed > 0 && d > r.maxElapsed-time.Since(r.start)
+}
+
+// consult asks the RetryPolicy if err should be retried and returns the delay
+// a built-in policy wants Retry to wait before the next attempt. The built-in
+// policies are reset the first time they are consulted during an operation.
+func (r *retry) consult(err error, resetDelay bool) (bool, time.Duration) {
+	c := &consultation{err: err, reset: !r.consulted, resetDelay: resetDelay}
+	r.consulted = true
+	ok := r.policy(c)
+	return ok, c.delay
+}
+
+// retryDeadline returns the deadline carried by err, if any.
+func retryDeadline(err error) (time.Time, bool) {
+	var carrier DeadlineCarrier
+	if !errors.As(err, &carrier) {
+		return time.Time{}, false
+	}
+	deadline := carrier.RetryDeadline()
+	return deadline, !deadline.IsZero()
+}
+
+// retryAfter returns the delay requested by err if it carries one, otherwise d.
+func retryAfter(err error, d time.Duration) time.Duration {
+	var carrier RetryAfterCarrier
+	if !errors.As(err, &carrier) {
+		return d
+	}
+	if requested := carrier.RetryAfter(); requested > 0 {
+		return requested
+	}
+	return 0
+}
+
+// release clears r, keeping the capacity of the collected errors, and returns it
+// to the pool. r must not be used once it has been released.
+func (r *retry) release() {
+	for i := range r.errs {
+		r.errs[i] = nil
+	}
+	*r = retry{errs: r.errs[:0]}
+	retryPool.Put(r)
+}
+
+// record remembers the error of the first attempt and keeps err if errors are
+// being collected. Once the history limit is reached the oldest error is
+// overwritten, treating errs as a ring buffer.
+func (r *retry) record(err error) {
+	if r.first == nil {
+		r.first = err
+	}
+	if r.result != nil {
+		r.result.Errors = append(r.result.Errors, err)
+	}
+	if !r.collectErrors {
+		return
+	}
+	if r.historyLimit > 0 && len(r.errs) == r.historyLimit {
+		r.errs[r.dropped%r.historyLimit] = err
+		r.dropped++
+		return
+	}
+	r.errs = append(r.errs, err)
+}
+
+// giveUp returns the UnrecoverableError for the final error err.
+func (r *retry) giveUp(err error) error {
+	if r.onGiveUp != nil {
+		r.onGiveUp(r.attempts, err)
+	}
+	if r.logger != nil {
+		r.logger.Logf("riprovare: giving up after %d attempts: %v", r.attempts, err)
+	}
+	if r.withoutWrap {
+		return err
+	}
+	u := UnrecoverableError{
+		Err:      err,
+		First:    r.first,
+		Dropped:  r.dropped,
+		attempts: r.attempts,
+		elapsed:  time.Since(r.start),
+	}
+	if r.collectErrors {
+		start := r.dropped % len(r.errs)
+		u.Errs = append(append(make([]error, 0, len(r.errs)), r.errs[start:]...), r.errs[:start]...)
+	}
+	return u
+}
+
+// abandon returns the error Retry returns when it stops retrying for the given
+// reason before the retries have been exhausted.
+func (r *retry) abandon(reason AbandonReason, err error) error {
+	if r.logger != nil {
+		r.logger.Logf("riprovare: abandoning retries after %d attempts (%s): %v", r.attempts, reason, err)
+	}
+	if r.withoutWrap {
+		return err
+	}
+	return AbandonedError{Reason: reason, Err: err}
+}
+
+// contextDone reports if err was caused by a context being canceled or its
+// deadline passing. Errors of attempts timed out by WithPerAttemptTimeout are
+// excluded as the operation itself may still be retried.
+func contextDone(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return true
+	}
+	var timeout attemptTimeoutError
+	return errors.Is(err, context.DeadlineExceeded) && !errors.As(err, &timeout)
+}
+
+// attemptTimeoutError marks the error of an attempt that was timed out by
+// WithPerAttemptTimeout.
+type attemptTimeoutError struct {
+	err error
+}
+
+func (a attemptTimeoutError) Error() string {
+	return a.err.Error()
+}
+
+func (a attemptTimeoutError) Unwrap() error {
+	return a.err
+}
+
+// isContextErr is the default matcher for errors caused by cancellation.
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// nextDelay computes how long Retry waits before the attempt following the
+// given failed attempt, given the delay of the RetryPolicy. The delay requested
+// by err takes precedence for any RetryPolicy.
+func (r *retry) nextDelay(attempt int, err error, policyDelay time.Duration) time.Duration {
+	d := policyDelay
+	if r.delay != nil {
+		d = addDelay(d, r.delay(attempt, err))
+	}
+	d = retryAfter(err, d)
+	if r.interceptDelay != nil {
+		d = r.interceptDelay(attempt, d, err)
+	}
+	if d < 0 {
+		d = 0
+	}
+	if r.maxDelay > 0 && d >= r.maxDelay {
+		d = r.maxDelay
+		r.capped++
+		if r.warnCap != nil && r.capped == r.capThreshold {
+			r.warnCap(attempt)
+		}
+	}
+	return d
+}
+
+// sleep waits for the duration d. If a context has been configured the wait ends
+// early when the context is done, in which case the error of the context is
+// returned.
+func (r *retry) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	if r.ctx == nil {
+		time.Sleep(d)
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Permanent marks err as permanent, when a Retryable returns an error wrapping a
+// permanent error Retry stops immediately, regardless of the RetryPolicy, and
+// returns err as is instead of an UnrecoverableError. Permanent returns nil if
+// err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+func (p permanentError) Unwrap() error {
+	return p.err
+}
+
+// AbandonReason describes why Retry stopped retrying before the retries had been
+// exhausted.
+type AbandonReason string
+
+const (
+	// ReasonCanceled means an attempt failed because of cancellation, such as a
+	// context being canceled or its deadline passing.
+	ReasonCanceled AbandonReason = "canceled"
+	// ReasonNotRetryable means the classifier configured using RetryIf or
+	// AbortIf decided the error was not worth retrying.
+	ReasonNotRetryable AbandonReason = "not retryable"
+)
+
+// AbandonedError is returned by Retry when it stops retrying for a reason other
+// than the retries being exhausted, which allows callers to tell an operation
+// that was canceled or failed with an error not worth retrying apart from one
+// that kept failing, for which an UnrecoverableError is returned. Err is the
+// error of the final attempt. If Retry itself observes that the context
+// configured using WithContext is done, the error of the context is returned
+// instead.
+type AbandonedError struct {
+	Reason AbandonReason
+	Err    error
+}
+
+func (a AbandonedError) Error() string {
+	return fmt.Sprintf("retries abandoned (%s): %s", a.Reason, a.Err)
+}
+
+// Unwrap returns the error of the final attempt.
+func (a AbandonedError) Unwrap() error {
+	return a.Err
+}
+
+type UnrecoverableError struct {
+	Err error
+
+	// First is the error of the first attempt, which is often the root cause
+	// when later attempts fail with errors that are merely its symptoms.
+	First error
+
+	// Errs holds the errors of the failed attempts, oldest first, when errors
+	// are collected using CollectErrors or WithErrorHistoryLimit.
+	Errs []error
+
+	// Dropped is the number of errors that were not kept in Errs because of the
+	// limit set with WithErrorHistoryLimit.
+	Dropped int
+
+	attempts int
+	elapsed  time.Duration
+}
+
+// Attempts returns the number of attempts made before Retry gave up.
+func (u UnrecoverableError) Attempts() int {
+	return u.attempts
+}
+
+// Elapsed returns the time elapsed from the start of the first attempt until
+// Retry gave up, excluding the delay configured using WithInitialDelay.
+func (u UnrecoverableError) Elapsed() time.Duration {
+	return u.elapsed
+}
+
+func (u UnrecoverableError) Error() string {
+	if len(u.Errs) == 0 {
+		if u.First != nil && u.Err != nil && u.First.Error() != u.Err.Error() {
+			return fmt.Sprintf("max retries exceeded: %s (first error: %s)", u.Err, u.First)
+		}
+		return fmt.Sprintf("max retries exceeded: %s", u.Err)
+	}
+	var b strings.Builder
+	b.WriteString("max retries exceeded: ")
+	for i, err := range u.Errs {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(err.Error())
+	}
+	if u.Dropped > 0 {
+		fmt.Fprintf(&b, " (%d earlier errors dropped)", u.Dropped)
+	}
+	return b.String()
+}
+
+// Is reports whether target is ErrRetriesExhausted, so errors.Is(err,
+// ErrRetriesExhausted) detects that Retry gave up regardless of the error that
+// caused it.
+func (u UnrecoverableError) Is(target error) bool {
+	return target == ErrRetriesExhausted
+}
+
+// Unwrap returns the error that caused Retry to give up followed by the error of
+// the first attempt and the errors collected from the failed attempts, if any,
+// allowing errors.Is and errors.As to inspect all of them.
+func (u UnrecoverableError) Unwrap() []error {
+	errs := make([]error, 0, len(u.Errs)+2)
+	if u.Err != nil {
+		errs = append(errs, u.Err)
+	}
+	if u.First != nil {
+		errs = append(errs, u.First)
+	}
+	return append(errs, u.Errs...)
+}
+
+// exponentialBase returns initial * 2^n. It is computed by shifting, which is
+// exact unlike repeated floating point multiplication, and saturates at the
+// maximum duration instead of overflowing.
+func exponentialBase(initial time.Duration, n int) time.Duration {
+	if initial <= 0 {
+		return initial
+	}
+	if n >= 63 || initial > math.MaxInt64>>n {
+		return math.MaxInt64
+	}
+	return initial << n
+}
+
+// fibonacciBase returns unit * fib(n) where fib(1) and fib(2) are 1, saturating
+// at the maximum duration instead of overflowing.
+func fibonacciBase(unit time.Duration, n int) time.Duration {
+	if unit <= 0 {
+		return unit
+	}
+	a, b := time.Duration(1), time.Duration(1)
+	for i := 1; i < n; i++ {
+		if a > math.MaxInt64-b {
+			return math.MaxInt64
+		}
+		a, b = b, a+b
+	}
+	if a > math.MaxInt64/unit {
+		return math.MaxInt64
+	}
+	return a * unit
+}
+
+// linearBase returns initial + increment * n, saturating at the maximum
+// duration instead of overflowing.
+func linearBase(initial, increment time.Duration, n int) time.Duration {
+	if increment > 0 && time.Duration(n) > (math.MaxInt64-initial)/increment {
+		return math.MaxInt64
+	}
+	return initial + increment*time.Duration(n)
+}
+
+// exponentialScaled returns initial * factor^n, saturating at the maximum
+// duration instead of overflowing. A factor of 2 is computed exactly with
+// exponentialBase.
+func exponentialScaled(initial time.Duration, factor float64, n int) time.Duration {
+	if factor == 2 {
+		return exponentialBase(initial, n)
+	}
+	d := float64(initial) * math.Pow(factor, float64(n))
+	if d >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// defaultRand is the source of randomness for jitter unless one is provided
+// using WithRand. It is private to this package so the global source of
+// programs using it is left alone.
+var defaultRand = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
+
+// lockedSource is a rand.Source that is safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (l *lockedSource) Int63() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.src.Int63()
+}
+
+func (l *lockedSource) Seed(seed int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.src.Seed(seed)
+}
+
+// jitter randomly varies d by +/- 25%.
+func jitter(r *rand.Rand, d time.Duration) time.Duration {
+	return proportionalJitter(r, d, 0.25)
+}
+
+// proportionalJitter randomly varies d by +/- fraction of d.
+func proportionalJitter(r *rand.Rand, d time.Duration, fraction float64) time.Duration {
+	f := float64(d) * (1 - fraction + r.Float64()*2*fraction)
+	if f >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(f)
 }
@@ -1,8 +1,15 @@
 package riprovare
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
 	"testing"
 	"time"
 
@@ -47,13 +54,370 @@ func TestRetry_Recovered(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRetryN(t *testing.T) {
+	counter := 0
+	attempts, err := RetryN(SimpleRetryPolicy(5), func() error {
+		counter++
+		if counter < 3 {
+			return fmt.Errorf("oh snap this broke")
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetry_ManyAttempts(t *testing.T) {
+	pcs := make([]uintptr, 256)
+	var firstDepth, lastDepth int
+	counter := 0
+	err := Retry(SimpleRetryPolicy(10000), func() error {
+		counter++
+		switch counter {
+		case 1:
+			firstDepth = runtime.Callers(0, pcs)
+		case 10000:
+			lastDepth = runtime.Callers(0, pcs)
+			return nil
+		}
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 10000, counter)
+	// The stack doesn't grow with the number of attempts
+	assert.Equal(t, firstDepth, lastDepth)
+}
+
+func TestRetryN_Failure(t *testing.T) {
+	attempts, err := RetryN(SimpleRetryPolicy(4), func() error {
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 4, attempts)
+}
+
+func TestRetryDetailed(t *testing.T) {
+	counter := 0
+	result, err := RetryDetailed(FixedRetryPolicy(5, 10*time.Millisecond), func() error {
+		counter++
+		if counter < 3 {
+			return fmt.Errorf("attempt %d broke", counter)
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.Attempts)
+	assert.True(t, result.Succeeded)
+	assert.GreaterOrEqual(t, result.TotalDuration, 20*time.Millisecond)
+	assert.Len(t, result.Errors, 2)
+	assert.EqualError(t, result.Errors[0], "attempt 1 broke")
+	assert.EqualError(t, result.Errors[1], "attempt 2 broke")
+}
+
+func TestRetryDetailed_Failure(t *testing.T) {
+	counter := 0
+	result, err := RetryDetailed(SimpleRetryPolicy(4), func() error {
+		counter++
+		return fmt.Errorf("attempt %d broke", counter)
+	}, WithErrorHistoryLimit(1))
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 4, result.Attempts)
+	assert.False(t, result.Succeeded)
+	// The history limit only applies to the UnrecoverableError
+	assert.Len(t, result.Errors, 4)
+	assert.EqualError(t, result.Errors[3], "attempt 4 broke")
+}
+
+func TestUnrecoverableError_First(t *testing.T) {
+	root := errors.New("disk full")
+	counter := 0
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		switch counter {
+		case 1:
+			return root
+		case 2:
+			return errors.New("write failed")
+		default:
+			return errors.New("replica out of sync")
+		}
+	})
+
+	var unrecoverable UnrecoverableError
+	assert.ErrorAs(t, err, &unrecoverable)
+	assert.Equal(t, root, unrecoverable.First)
+	assert.EqualError(t, unrecoverable.Err, "replica out of sync")
+	assert.ErrorIs(t, err, root)
+	assert.EqualError(t, err, "max retries exceeded: replica out of sync (first error: disk full)")
+
+	// A single attempt reports its error once
+	err = Retry(SimpleRetryPolicy(1), func() error {
+		return root
+	})
+	assert.EqualError(t, err, "max retries exceeded: disk full")
+}
+
+func TestUnrecoverableError_Is(t *testing.T) {
+	sentinel := errors.New("sentinel")
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		return fmt.Errorf("oh snap this broke: %w", sentinel)
+	})
+
+	assert.ErrorIs(t, err, ErrRetriesExhausted)
+	assert.ErrorIs(t, err, sentinel)
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.ErrorIs(t, fmt.Errorf("sync failed: %w", err), ErrRetriesExhausted)
+
+	err = Retry(SimpleRetryPolicy(3), func() error {
+		return Permanent(sentinel)
+	})
+	assert.NotErrorIs(t, err, ErrRetriesExhausted)
+}
+
+func TestUnrecoverableError_Unwrap(t *testing.T) {
+	sentinel := errors.New("sentinel")
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		return fmt.Errorf("oh snap this broke: %w", sentinel)
+	})
+
+	assert.ErrorIs(t, err, sentinel)
+	var lease leaseError
+	assert.False(t, errors.As(err, &lease))
+
+	err = Retry(SimpleRetryPolicy(2), func() error {
+		return leaseError{expires: time.Now().Add(time.Hour)}
+	})
+	assert.ErrorAs(t, err, &lease)
+}
+
+func TestRetry_Permanent(t *testing.T) {
+	invalid := errors.New("invalid request")
+	counter := 0
+	hookCalls := 0
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		if counter == 2 {
+			return fmt.Errorf("request failed: %w", Permanent(invalid))
+		}
+		return fmt.Errorf("oh snap this broke")
+	}, ErrorHook(func(err error) {
+		hookCalls++
+	}))
+
+	assert.Equal(t, invalid, err)
+	assert.Equal(t, 2, counter)
+	assert.Equal(t, 2, hookCalls)
+}
+
+func TestPermanent_Nil(t *testing.T) {
+	assert.NoError(t, Permanent(nil))
+}
+
+func TestRetry_RetryIf(t *testing.T) {
+	transient := errors.New("transient")
+	fatal := errors.New("fatal")
+	counter := 0
+	policyCalls := 0
+	err := Retry(func(err error) bool {
+		policyCalls++
+		return true
+	}, func() error {
+		counter++
+		if counter < 3 {
+			return transient
+		}
+		return fatal
+	}, RetryIf(func(err error) bool {
+		return errors.Is(err, transient)
+	}))
+
+	var abandoned AbandonedError
+	assert.ErrorAs(t, err, &abandoned)
+	assert.Equal(t, ReasonNotRetryable, abandoned.Reason)
+	assert.Equal(t, fatal, abandoned.Err)
+	assert.NotErrorIs(t, err, ErrRetriesExhausted)
+	assert.Equal(t, 3, counter)
+	assert.Equal(t, 2, policyCalls)
+}
+
+func TestRetry_AbortIf(t *testing.T) {
+	fatal := errors.New("fatal")
+	counter := 0
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		if counter < 3 {
+			return errors.New("transient")
+		}
+		return fmt.Errorf("insert failed: %w", fatal)
+	}, AbortIf(func(err error) bool {
+		return errors.Is(err, fatal)
+	}))
+
+	var abandoned AbandonedError
+	assert.ErrorAs(t, err, &abandoned)
+	assert.Equal(t, ReasonNotRetryable, abandoned.Reason)
+	assert.ErrorIs(t, err, fatal)
+	assert.Equal(t, 3, counter)
+
+	assert.Panics(t, func() {
+		AbortIf(nil)
+	})
+}
+
+func TestRetry_AbandonedCanceled(t *testing.T) {
+	counter := 0
+	err := Retry(FixedRetryPolicy(5, time.Millisecond), func() error {
+		counter++
+		return fmt.Errorf("query failed: %w", context.Canceled)
+	})
+
+	// The policy declined because of the cancellation, not exhaustion
+	var abandoned AbandonedError
+	assert.ErrorAs(t, err, &abandoned)
+	assert.Equal(t, ReasonCanceled, abandoned.Reason)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NotErrorIs(t, err, ErrRetriesExhausted)
+	assert.EqualError(t, err, "retries abandoned (canceled): query failed: context canceled")
+	assert.Equal(t, 1, counter)
+
+	err = Retry(SimpleRetryPolicy(1), func() error {
+		return fmt.Errorf("query failed: %w", context.Canceled)
+	}, WithoutWrap())
+	assert.EqualError(t, err, "query failed: context canceled")
+}
+
+func TestSimpleRetryPolicy_SingleAttempt(t *testing.T) {
+	counter := 0
+	err := Retry(SimpleRetryPolicy(1), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, counter)
+}
+
+func TestRetryPolicy_Attempts(t *testing.T) {
+	policies := map[string]func(attempts int) RetryPolicy{
+		"simple": SimpleRetryPolicy,
+		"fixed": func(attempts int) RetryPolicy {
+			return FixedRetryPolicy(attempts, time.Millisecond)
+		},
+		"exponential": func(attempts int) RetryPolicy {
+			return ExponentialBackoffRetryPolicy(attempts, time.Millisecond)
+		},
+		"capped exponential": func(attempts int) RetryPolicy {
+			return CappedExponentialBackoffRetryPolicy(attempts, time.Millisecond, 2*time.Millisecond)
+		},
+		"fibonacci": func(attempts int) RetryPolicy {
+			return FibonacciBackoffRetryPolicy(attempts, time.Millisecond)
+		},
+		"decorrelated jitter": func(attempts int) RetryPolicy {
+			return DecorrelatedJitterRetryPolicy(attempts, time.Millisecond, 2*time.Millisecond)
+		},
+		"backoff": func(attempts int) RetryPolicy {
+			return BackoffRetryPolicy(WithMaxAttemptsBackoff(NewFixedBackoff(time.Millisecond), attempts))
+		},
+	}
+
+	for name, policy := range policies {
+		for attempts := 1; attempts <= 3; attempts++ {
+			t.Run(fmt.Sprintf("%s %d", name, attempts), func(t *testing.T) {
+				counter := 0
+				err := Retry(policy(attempts), func() error {
+					counter++
+					return fmt.Errorf("oh snap this broke")
+				})
+				assert.Error(t, err)
+				assert.Equal(t, attempts, counter)
+			})
+		}
+	}
+}
+
+func TestRetryPolicy_InvalidArguments(t *testing.T) {
+	tests := []struct {
+		name   string
+		create func()
+	}{
+		{name: "simple zero attempts", create: func() { SimpleRetryPolicy(0) }},
+		{name: "simple negative attempts", create: func() { SimpleRetryPolicy(-1) }},
+		{name: "fixed zero attempts", create: func() { FixedRetryPolicy(0, time.Second) }},
+		{name: "fixed negative delay", create: func() { FixedRetryPolicy(3, -time.Second) }},
+		{name: "exponential negative delay", create: func() { ExponentialBackoffRetryPolicy(3, -time.Second) }},
+		{name: "capped zero max delay", create: func() { CappedExponentialBackoffRetryPolicy(3, time.Second, 0) }},
+		{name: "fibonacci zero attempts", create: func() { FibonacciBackoffRetryPolicy(0, time.Second) }},
+		{name: "decorrelated max below base", create: func() { DecorrelatedJitterRetryPolicy(3, time.Second, time.Millisecond) }},
+		{name: "decorrelated zero base", create: func() { DecorrelatedJitterRetryPolicy(3, 0, time.Second) }},
+		{name: "max attempts backoff zero", create: func() { WithMaxAttemptsBackoff(NewFixedBackoff(time.Second), 0) }},
+		{name: "fixed backoff negative delay", create: func() { NewFixedBackoff(-time.Second) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Panics(t, test.create)
+		})
+	}
+}
+
+// errFailed is the error of a failed attempt passed to policies invoked directly.
+var errFailed = errors.New("oh snap this broke")
+
+// policyDelays consults policy like Retry does until it declines to retry
+// errFailed and returns the delays it asked Retry to wait, so the delays of the
+// built-in policies can be asserted without waiting for them.
+func policyDelays(policy RetryPolicy) []time.Duration {
+	var delays []time.Duration
+	for {
+		c := consultation{err: errFailed}
+		if !policy(&c) {
+			return delays
+		}
+		delays = append(delays, c.delay)
+	}
+}
+
+func TestRetryPolicy_NilError(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+	}{
+		{name: "simple", policy: SimpleRetryPolicy(2)},
+		{name: "fixed", policy: FixedRetryPolicy(2, time.Hour)},
+		{name: "exponential", policy: ExponentialBackoffRetryPolicy(2, time.Hour)},
+		{name: "fibonacci", policy: FibonacciBackoffRetryPolicy(2, time.Hour)},
+		{name: "decorrelated jitter", policy: DecorrelatedJitterRetryPolicy(2, time.Hour, time.Hour)},
+		{name: "weighted", policy: WeightedRetryPolicy(2, func(error) float64 { return 1 }, func(int) time.Duration { return time.Hour })},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				assert.False(t, test.policy(nil))
+			}
+			assert.Less(t, time.Since(start), time.Second)
+		})
+	}
+
+	// A nil error doesn't count as an attempt
+	policy := SimpleRetryPolicy(2)
+	assert.False(t, policy(nil))
+	assert.True(t, policy(errFailed))
+}
+
 func TestFixedRetryPolicy(t *testing.T) {
 	counter := 0
 	start := time.Now()
 	policy := FixedRetryPolicy(3, time.Second*1)
 	for i := 0; i <= 2; i++ {
 		counter++
-		if !policy(nil) {
+		if !policy(errFailed) {
 			break
 		}
 	}
@@ -73,6 +437,46 @@ func TestFixedRetryPolicy_ContextCanceled(t *testing.T) {
 	assert.Equal(t, 1, counter)
 }
 
+func TestRetryPolicy_ContextDeadlineExceeded(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+	}{
+		{name: "simple", policy: SimpleRetryPolicy(3)},
+		{name: "fixed", policy: FixedRetryPolicy(3, time.Second)},
+		{name: "exponential", policy: ExponentialBackoffRetryPolicy(3, time.Second)},
+		{name: "fibonacci", policy: FibonacciBackoffRetryPolicy(3, time.Second)},
+		{name: "decorrelated jitter", policy: DecorrelatedJitterRetryPolicy(3, time.Second, time.Minute)},
+		{name: "weighted", policy: WeightedRetryPolicy(3, func(error) float64 { return 1 }, nil)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counter := 0
+			for i := 0; i <= 2; i++ {
+				counter++
+				if !test.policy(fmt.Errorf("query failed: %w", context.DeadlineExceeded)) {
+					break
+				}
+			}
+			assert.Equal(t, 1, counter)
+		})
+	}
+}
+
+func TestRetryCtx_PerAttemptTimeoutBuiltinPolicy(t *testing.T) {
+	counter := 0
+	err := RetryCtx(context.Background(), FixedRetryPolicy(3, time.Millisecond), func(ctx context.Context) error {
+		counter++
+		<-ctx.Done()
+		return ctx.Err()
+	}, WithPerAttemptTimeout(10*time.Millisecond))
+
+	// Timed out attempts are retried even though the policy stops on deadlines
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 3, counter)
+}
+
 func TestExponentialBackoffRetryPolicy(t *testing.T) {
 	counter := 0
 	lastDuration := time.Duration(0)
@@ -80,7 +484,7 @@ func TestExponentialBackoffRetryPolicy(t *testing.T) {
 	for i := 0; i <= 2; i++ {
 		counter++
 		start := time.Now()
-		if !policy(nil) {
+		if !policy(errFailed) {
 			break
 		}
 		duration := time.Since(start)
@@ -102,19 +506,1903 @@ func TestExponentialBackoffRetryPolicy_ContextCanceled(t *testing.T) {
 	assert.Equal(t, 1, counter)
 }
 
-func TestRetry_ErrorHook(t *testing.T) {
+func TestCappedExponentialBackoffRetryPolicy(t *testing.T) {
+	maxDelay := 20 * time.Millisecond
+	policy := CappedExponentialBackoffRetryPolicy(6, 10*time.Millisecond, maxDelay)
+	var durations []time.Duration
+	for {
+		start := time.Now()
+		if !policy(errFailed) {
+			break
+		}
+		durations = append(durations, time.Since(start))
+	}
+
+	assert.Len(t, durations, 5)
+	for _, d := range durations {
+		assert.Less(t, d, maxDelay+15*time.Millisecond)
+	}
+	// Even with minimal jitter the last two delays are past the cap
+	for _, d := range durations[3:] {
+		assert.GreaterOrEqual(t, d, maxDelay)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := 2 * time.Second
+	for i := 0; i < 1000; i++ {
+		delay := jitter(defaultRand, d)
+		assert.GreaterOrEqual(t, delay, 1500*time.Millisecond)
+		assert.LessOrEqual(t, delay, 2500*time.Millisecond)
+	}
+}
+
+func TestRetryPolicy_Reused(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+	}{
+		{name: "simple", policy: SimpleRetryPolicy(3)},
+		{name: "fixed", policy: FixedRetryPolicy(3, time.Millisecond)},
+		{name: "exponential", policy: ExponentialBackoffRetryPolicy(3, time.Millisecond)},
+		{name: "capped exponential", policy: CappedExponentialBackoffRetryPolicy(3, time.Millisecond, 2*time.Millisecond)},
+		{name: "weighted", policy: WeightedRetryPolicy(3, func(error) float64 { return 1 }, nil)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				counter := 0
+				err := Retry(test.policy, func() error {
+					counter++
+					return fmt.Errorf("oh snap this broke")
+				})
+				assert.Error(t, err)
+				assert.Equal(t, 3, counter)
+			}
+
+			// A policy is also reset when the operation succeeds before exhausting it
+			counter := 0
+			err := Retry(test.policy, func() error {
+				if counter++; counter < 2 {
+					return fmt.Errorf("oh snap this broke")
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+			counter = 0
+			err = Retry(test.policy, func() error {
+				counter++
+				return fmt.Errorf("oh snap this broke")
+			})
+			assert.Error(t, err)
+			assert.Equal(t, 3, counter)
+		})
+	}
+}
+
+func TestRetry_PolicyConsultedOnlyOnFailure(t *testing.T) {
+	var consulted []error
+	policy := func(err error) bool {
+		consulted = append(consulted, err)
+		time.Sleep(100 * time.Millisecond)
+		return true
+	}
+
+	start := time.Now()
+	err := Retry(policy, func() error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, consulted)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+
 	counter := 0
-	hookCounter := 0
+	err = Retry(policy, func() error {
+		if counter++; counter < 2 {
+			return errFailed
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	// The policy receives an error wrapping the error of the attempt
+	if assert.Len(t, consulted, 1) {
+		assert.ErrorIs(t, consulted[0], errFailed)
+		assert.Equal(t, errFailed.Error(), consulted[0].Error())
+	}
+}
 
-	hook := OnErrorFunc(func(err error) {
-		hookCounter++
+func TestRetry_WithContextSleepingPolicy(t *testing.T) {
+	consulted := 0
+	policy := func(err error) bool {
+		consulted++
+		time.Sleep(50 * time.Millisecond)
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	counter := 0
+	err := RetryContext(ctx, policy, func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
 	})
 
-	err := Retry(SimpleRetryPolicy(3), func() error {
+	// The policy sleeps on its own, Retry stops once it returns
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, counter)
+	assert.Equal(t, 1, consulted)
+}
+
+func TestExponentialBackoffRetryPolicy_WithRand(t *testing.T) {
+	delays := policyDelays(ExponentialBackoffRetryPolicy(5, 100*time.Millisecond, WithRand(rand.New(rand.NewSource(1)))))
+
+	r := rand.New(rand.NewSource(1))
+	expected := []time.Duration{100 * time.Millisecond}
+	for _, d := range []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond} {
+		expected = append(expected, time.Duration(float64(d)*(0.75+r.Float64()*0.5)))
+	}
+	assert.Equal(t, expected, delays)
+
+	// The same seed produces the same delays
+	delays = policyDelays(CappedExponentialBackoffRetryPolicy(5, 100*time.Millisecond, time.Second, WithRand(rand.New(rand.NewSource(1)))))
+	assert.Equal(t, expected, delays)
+}
+
+func TestExponentialBackoffRetryPolicy_WithoutJitter(t *testing.T) {
+	delays := policyDelays(ExponentialBackoffRetryPolicy(6, 100*time.Millisecond, WithJitter(false)))
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		1600 * time.Millisecond,
+	}, delays)
+
+	delays = policyDelays(FibonacciBackoffRetryPolicy(6, 100*time.Millisecond, WithJitter(false)))
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond,
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		300 * time.Millisecond,
+		500 * time.Millisecond,
+	}, delays)
+}
+
+func TestExponentialBackoffRetryPolicy_WithJitterStrategy(t *testing.T) {
+	var bases []time.Duration
+	plusOne := func(base time.Duration) time.Duration {
+		bases = append(bases, base)
+		return base + time.Millisecond
+	}
+	delays := policyDelays(ExponentialBackoffRetryPolicy(4, 100*time.Millisecond, WithJitterStrategy(plusOne)))
+
+	// The first delay is not jittered
+	assert.Equal(t, []time.Duration{200 * time.Millisecond, 400 * time.Millisecond}, bases)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 201 * time.Millisecond, 401 * time.Millisecond}, delays)
+
+	delays = policyDelays(FibonacciBackoffRetryPolicy(4, 100*time.Millisecond, WithJitterStrategy(NoJitter)))
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}, delays)
+
+	assert.Panics(t, func() {
+		WithJitterStrategy(nil)
+	})
+}
+
+func TestJitterStrategies(t *testing.T) {
+	base := 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, base, NoJitter(base))
+
+		full := FullJitter(base)
+		assert.GreaterOrEqual(t, full, time.Duration(0))
+		assert.LessOrEqual(t, full, base)
+
+		equal := EqualJitter(base)
+		assert.GreaterOrEqual(t, equal, base/2)
+		assert.LessOrEqual(t, equal, base)
+	}
+	proportional := ProportionalJitter(0.1)
+	for i := 0; i < 100; i++ {
+		d := proportional(base)
+		assert.GreaterOrEqual(t, d, 90*time.Millisecond)
+		assert.LessOrEqual(t, d, 110*time.Millisecond)
+	}
+	assert.Equal(t, base, ProportionalJitter(0)(base))
+	assert.Panics(t, func() {
+		ProportionalJitter(1.5)
+	})
+
+	assert.Equal(t, time.Duration(0), FullJitter(0))
+	assert.Equal(t, time.Duration(0), EqualJitter(0))
+	assert.LessOrEqual(t, EqualJitter(math.MaxInt64), time.Duration(math.MaxInt64))
+}
+
+func TestExponentialBackoffRetryPolicy_JitterDoesNotCompound(t *testing.T) {
+	const runs = 501
+	samples := make([][]time.Duration, 6)
+	for i := 0; i < runs; i++ {
+		policy := ExponentialBackoffRetryPolicy(7, 100*time.Millisecond, WithRand(rand.New(rand.NewSource(int64(i)))))
+		for n, d := range policyDelays(policy) {
+			samples[n] = append(samples[n], d)
+		}
+	}
+
+	// Jitter is applied to initialDelay * 2^n, so the median of each delay stays
+	// close to the pure exponential schedule rather than drifting
+	for n, delays := range samples {
+		assert.Len(t, delays, runs)
+		sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+		base := exponentialBase(100*time.Millisecond, n)
+		assert.InDelta(t, float64(base), float64(delays[runs/2]), float64(base)*0.05, "delay %d", n+1)
+	}
+}
+
+func TestLinearRetryPolicy(t *testing.T) {
+	counter := 0
+	err := Retry(LinearRetryPolicy(5, time.Millisecond, time.Millisecond), func() error {
 		counter++
 		return fmt.Errorf("oh snap this broke")
-	}, ErrorHook(hook))
+	})
+
 	assert.Error(t, err)
-	assert.Equal(t, 3, counter)
-	assert.Equal(t, 3, hookCounter)
+	assert.Equal(t, 5, counter)
+
+	delays := policyDelays(LinearRetryPolicy(5, 100*time.Millisecond, 50*time.Millisecond, WithJitter(false)))
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond,
+		150 * time.Millisecond,
+		200 * time.Millisecond,
+		250 * time.Millisecond,
+	}, delays)
+
+	// The delays are jittered by default
+	delays = policyDelays(LinearRetryPolicy(3, 100*time.Millisecond, 100*time.Millisecond))
+	assert.Len(t, delays, 2)
+	assert.InDelta(t, float64(200*time.Millisecond), float64(delays[1]), float64(50*time.Millisecond))
+
+	assert.Panics(t, func() {
+		LinearRetryPolicy(3, time.Second, -time.Second)
+	})
+}
+
+func TestSchedulePolicy(t *testing.T) {
+	counter := 0
+	start := time.Now()
+	policy := SchedulePolicy(10*time.Millisecond, 30*time.Millisecond, 20*time.Millisecond)
+	err := Retry(policy, func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 4, counter)
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+
+	// The schedule starts over for the next operation
+	counter = 0
+	_ = Retry(policy, func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+	assert.Equal(t, 4, counter)
+
+	counter = 0
+	_ = Retry(SchedulePolicy(), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+	assert.Equal(t, 1, counter)
+
+	assert.Panics(t, func() {
+		SchedulePolicy(time.Second, -time.Second)
+	})
+}
+
+func TestLinearBase(t *testing.T) {
+	assert.Equal(t, 7*time.Second, linearBase(time.Second, 2*time.Second, 3))
+	assert.Equal(t, time.Second, linearBase(time.Second, 0, 1000))
+	assert.Equal(t, time.Duration(math.MaxInt64), linearBase(time.Second, time.Hour, math.MaxInt32))
+}
+
+func TestFibonacciBackoffRetryPolicy(t *testing.T) {
+	counter := 0
+	err := Retry(FibonacciBackoffRetryPolicy(7, time.Millisecond), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 7, counter)
+
+	delays := policyDelays(FibonacciBackoffRetryPolicy(7, 100*time.Millisecond, WithRand(rand.New(rand.NewSource(1)))))
+	r := rand.New(rand.NewSource(1))
+	var expected []time.Duration
+	for _, fib := range []time.Duration{1, 1, 2, 3, 5, 8} {
+		expected = append(expected, time.Duration(float64(fib*100*time.Millisecond)*(0.75+r.Float64()*0.5)))
+	}
+	assert.Equal(t, expected, delays)
+}
+
+func TestFibonacciBackoffRetryPolicy_ContextCanceled(t *testing.T) {
+	policy := FibonacciBackoffRetryPolicy(3, time.Second)
+	assert.False(t, policy(context.Canceled))
+}
+
+func TestFibonacciBase(t *testing.T) {
+	var multiples []time.Duration
+	for n := 1; n <= 8; n++ {
+		multiples = append(multiples, fibonacciBase(time.Millisecond, n)/time.Millisecond)
+	}
+	assert.Equal(t, []time.Duration{1, 1, 2, 3, 5, 8, 13, 21}, multiples)
+	assert.Equal(t, time.Duration(math.MaxInt64), fibonacciBase(time.Second, 100))
+}
+
+func TestExponentialBackoffRetryPolicy_WithMultiplier(t *testing.T) {
+	delaysFor := func(factor float64) []time.Duration {
+		return policyDelays(ExponentialBackoffRetryPolicy(6, 100*time.Millisecond, WithMultiplier(factor), WithRand(rand.New(rand.NewSource(1)))))
+	}
+
+	gentle, doubling := delaysFor(1.5), delaysFor(2)
+	assert.Len(t, gentle, 5)
+	assert.Equal(t, gentle[0], doubling[0])
+	for i := 1; i < len(gentle); i++ {
+		// The same seed applies the same jitter to both
+		assert.Less(t, gentle[i], doubling[i])
+	}
+
+	assert.Panics(t, func() {
+		WithMultiplier(1)
+	})
+}
+
+func TestExponentialScaled(t *testing.T) {
+	var delays []time.Duration
+	for n := 0; n < 4; n++ {
+		delays = append(delays, exponentialScaled(100*time.Millisecond, 1.5, n))
+	}
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond,
+		150 * time.Millisecond,
+		225 * time.Millisecond,
+		337500 * time.Microsecond,
+	}, delays)
+	assert.Equal(t, exponentialBase(3, 40), exponentialScaled(3, 2, 40))
+	assert.Equal(t, time.Duration(math.MaxInt64), exponentialScaled(time.Second, 1.5, 1000))
+}
+
+func TestExponentialBase(t *testing.T) {
+	var delays []time.Duration
+	for n := 0; n < 6; n++ {
+		delays = append(delays, exponentialBase(100*time.Millisecond, n))
+	}
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		1600 * time.Millisecond,
+		3200 * time.Millisecond,
+	}, delays)
+
+	// 3ns does not accumulate any rounding error however many times it is doubled
+	assert.Equal(t, time.Duration(3<<40), exponentialBase(3, 40))
+	assert.Equal(t, time.Duration(math.MaxInt64), exponentialBase(time.Second, 40))
+	assert.Equal(t, time.Duration(math.MaxInt64), exponentialBase(time.Nanosecond, 63))
+}
+
+func TestRetry_ErrorHook(t *testing.T) {
+	counter := 0
+	hookCounter := 0
+
+	hook := OnErrorFunc(func(err error) {
+		hookCounter++
+	})
+
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, ErrorHook(hook))
+	assert.Error(t, err)
+	assert.Equal(t, 3, counter)
+	assert.Equal(t, 3, hookCounter)
+}
+
+func TestRetry_OnRetry(t *testing.T) {
+	var attempts []int
+	var delays []time.Duration
+	var errs []error
+	failure := fmt.Errorf("oh snap this broke")
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		return failure
+	}, WithDelayFunc(func(attempt int, err error) time.Duration {
+		return time.Duration(attempt) * time.Millisecond
+	}), OnRetry(func(attempt int, err error, nextDelay time.Duration) {
+		attempts = append(attempts, attempt)
+		errs = append(errs, err)
+		delays = append(delays, nextDelay)
+	}))
+
+	assert.Error(t, err)
+	// The final attempt is not retried
+	assert.Equal(t, []int{1, 2}, attempts)
+	assert.Equal(t, []error{failure, failure}, errs)
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond}, delays)
+}
+
+func TestRetry_OnRetryBeforeDelay(t *testing.T) {
+	var invoked []time.Duration
+	start := time.Now()
+	err := Retry(FixedRetryPolicy(3, 50*time.Millisecond), func() error {
+		return fmt.Errorf("oh snap this broke")
+	}, OnRetry(func(attempt int, err error, nextDelay time.Duration) {
+		invoked = append(invoked, time.Since(start))
+	}))
+
+	assert.Error(t, err)
+	// The hook runs as soon as an attempt failed, before the delay of the policy
+	assert.Len(t, invoked, 2)
+	assert.Less(t, invoked[0], 25*time.Millisecond)
+	assert.GreaterOrEqual(t, invoked[1], 50*time.Millisecond)
+	assert.Less(t, invoked[1], 75*time.Millisecond)
+}
+
+func TestRetry_OnRetryPolicyDelay(t *testing.T) {
+	var delays []time.Duration
+	err := Retry(ExponentialBackoffRetryPolicy(4, time.Millisecond, WithJitter(false)), func() error {
+		return fmt.Errorf("oh snap this broke")
+	}, WithDelayFunc(func(attempt int, err error) time.Duration {
+		return time.Millisecond
+	}), OnRetry(func(attempt int, err error, nextDelay time.Duration) {
+		delays = append(delays, nextDelay)
+	}))
+
+	assert.Error(t, err)
+	// The delays of the policy and the DelayFunc add up
+	assert.Equal(t, []time.Duration{2 * time.Millisecond, 3 * time.Millisecond, 5 * time.Millisecond}, delays)
+}
+
+func TestRetry_WrappedBuiltinPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		wrap func(err error) error
+	}{
+		{name: "error passed on", wrap: func(err error) error { return err }},
+		{name: "error wrapped", wrap: func(err error) error { return fmt.Errorf("wrapped: %w", err) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := FixedRetryPolicy(2, time.Hour)
+			var seen []error
+			policy := func(err error) bool {
+				seen = append(seen, err)
+				return inner(tt.wrap(err))
+			}
+
+			for i := 0; i < 2; i++ {
+				seen = nil
+				var delays []time.Duration
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				start := time.Now()
+				counter := 0
+				err := Retry(policy, func() error {
+					counter++
+					return errFailed
+				}, WithContext(ctx), OnRetry(func(attempt int, err error, nextDelay time.Duration) {
+					delays = append(delays, nextDelay)
+				}))
+				cancel()
+
+				// Retry waits the delay of the wrapped policy, so the context
+				// interrupts it, and the policy is reset for every operation
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+				assert.Less(t, time.Since(start), time.Second)
+				assert.Equal(t, 1, counter)
+				assert.Equal(t, []time.Duration{time.Hour}, delays)
+				if assert.Len(t, seen, 1) {
+					assert.ErrorIs(t, seen[0], errFailed)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_InvokedDirectly(t *testing.T) {
+	policy := FixedRetryPolicy(2, 20*time.Millisecond)
+
+	// Outside of Retry the policy waits its delay itself
+	start := time.Now()
+	assert.True(t, policy(errFailed))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.False(t, policy(errFailed))
+}
+
+func TestRetry_DelayFuncPerError(t *testing.T) {
+	errLocked, errReplica := errors.New("resource locked"), errors.New("try a different replica")
+	delayFor := func(attempt int, err error) time.Duration {
+		if errors.Is(err, errLocked) {
+			return 50 * time.Millisecond
+		}
+		return 0
+	}
+
+	counter := 0
+	start := time.Now()
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		if counter++; counter < 5 {
+			return errReplica
+		}
+		return nil
+	}, WithDelayFunc(delayFor))
+	assert.NoError(t, err)
+	// Errors without a delay are retried immediately
+	assert.Less(t, time.Since(start), 20*time.Millisecond)
+
+	counter = 0
+	start = time.Now()
+	err = Retry(SimpleRetryPolicy(5), func() error {
+		if counter++; counter < 3 {
+			return errLocked
+		}
+		return nil
+	}, WithDelayFunc(delayFor))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestRetry_OnSuccess(t *testing.T) {
+	calls := 0
+	var attempts int
+	var elapsed time.Duration
+	counter := 0
+	err := Retry(FixedRetryPolicy(3, 10*time.Millisecond), func() error {
+		counter++
+		if counter < 3 {
+			return errFailed
+		}
+		return nil
+	}, OnSuccess(func(n int, d time.Duration) {
+		calls++
+		attempts = n
+		elapsed = d
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 3, attempts)
+	assert.GreaterOrEqual(t, elapsed, 20*time.Millisecond)
+
+	calls = 0
+	err = Retry(SimpleRetryPolicy(3), func() error {
+		return errFailed
+	}, OnSuccess(func(int, time.Duration) {
+		calls++
+	}))
+	assert.Error(t, err)
+	assert.Equal(t, 0, calls)
+
+	assert.Panics(t, func() {
+		OnSuccess(nil)
+	})
+}
+
+func TestRetry_OnGiveUp(t *testing.T) {
+	calls := 0
+	var attempts int
+	var finalErr error
+	counter := 0
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return fmt.Errorf("failure %d", counter)
+	}, OnGiveUp(func(n int, err error) {
+		calls++
+		attempts = n
+		finalErr = err
+	}))
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 3, attempts)
+	assert.EqualError(t, finalErr, "failure 3")
+
+	calls = 0
+	err = Retry(SimpleRetryPolicy(3), func() error {
+		return nil
+	}, OnGiveUp(func(int, error) {
+		calls++
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, calls)
+}
+
+func TestRetry_WithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+	counter := 0
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return fmt.Errorf("failure %d", counter)
+	}, WithLogger(LoggerFunc(logger.Printf)), WithDelayFunc(func(attempt int, err error) time.Duration {
+		return time.Millisecond
+	}))
+
+	assert.Error(t, err)
+	assert.Equal(t, "riprovare: attempt 1 failed, retrying in 1ms: failure 1\n"+
+		"riprovare: attempt 2 failed, retrying in 1ms: failure 2\n"+
+		"riprovare: giving up after 3 attempts: failure 3\n", buf.String())
+
+	// The delays of the built-in policies are logged before they are waited
+	buf.Reset()
+	err = Retry(FixedRetryPolicy(2, 5*time.Millisecond), func() error {
+		return fmt.Errorf("oh snap this broke")
+	}, WithLogger(LoggerFunc(logger.Printf)))
+	assert.Error(t, err)
+	assert.Equal(t, "riprovare: attempt 1 failed, retrying in 5ms: oh snap this broke\n"+
+		"riprovare: giving up after 2 attempts: oh snap this broke\n", buf.String())
+
+	assert.NotPanics(t, func() {
+		NopLogger.Logf("discarded %d", 1)
+	})
+	assert.Panics(t, func() {
+		WithLogger(nil)
+	})
+}
+
+func TestRetry_WithIdempotencyCheck(t *testing.T) {
+	completed := false
+	counter, checks := 0, 0
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		if counter == 2 {
+			// The charge went through but the response timed out
+			completed = true
+		}
+		return fmt.Errorf("payment timed out")
+	}, WithIdempotencyCheck(func() (bool, error) {
+		checks++
+		return completed, nil
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counter)
+	assert.Equal(t, 2, checks)
+}
+
+func TestRetry_WithIdempotencyCheckFailed(t *testing.T) {
+	lookupErr := errors.New("lookup failed")
+	counter := 0
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		return fmt.Errorf("payment timed out")
+	}, WithIdempotencyCheck(func() (bool, error) {
+		return false, lookupErr
+	}))
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.ErrorIs(t, err, lookupErr)
+	assert.Equal(t, 1, counter)
+
+	assert.Panics(t, func() {
+		WithIdempotencyCheck(nil)
+	})
+}
+
+func TestRetry_SuppressFinalErrorHook(t *testing.T) {
+	counter := 0
+	hookCounter := 0
+
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, ErrorHook(func(err error) {
+		hookCounter++
+	}), WithSuppressFinalErrorHook())
+	assert.Error(t, err)
+	assert.Equal(t, 3, counter)
+	assert.Equal(t, 2, hookCounter)
+}
+
+func TestRetry_OnAuthError(t *testing.T) {
+	errUnauthorized := errors.New("401 unauthorized")
+	isUnauthorized := func(err error) bool {
+		return errors.Is(err, errUnauthorized)
+	}
+
+	token := "expired"
+	refreshes := 0
+	counter := 0
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		if token == "expired" {
+			return errUnauthorized
+		}
+		return nil
+	}, WithOnAuthError(isUnauthorized, func() error {
+		refreshes++
+		token = "fresh"
+		return nil
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counter)
+	assert.Equal(t, 1, refreshes)
+}
+
+func TestRetry_OnAuthErrorRefreshFailed(t *testing.T) {
+	errUnauthorized := errors.New("401 unauthorized")
+	errRefresh := errors.New("refresh token revoked")
+
+	counter := 0
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return errUnauthorized
+	}, WithOnAuthError(func(err error) bool {
+		return errors.Is(err, errUnauthorized)
+	}, func() error {
+		return errRefresh
+	}))
+
+	unrecoverable := UnrecoverableError{}
+	assert.ErrorAs(t, err, &unrecoverable)
+	assert.Equal(t, errRefresh, unrecoverable.Err)
+	assert.Equal(t, 1, counter)
+}
+
+func TestRetry_AttemptHistogram(t *testing.T) {
+	var observed []int
+	histogram := WithAttemptHistogram(func(attempts int) {
+		observed = append(observed, attempts)
+	})
+
+	counter := 0
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		if counter < 2 {
+			return fmt.Errorf("oh snap this broke")
+		}
+		return nil
+	}, histogram)
+	assert.NoError(t, err)
+
+	err = Retry(SimpleRetryPolicy(3), func() error {
+		return fmt.Errorf("oh snap this broke")
+	}, histogram)
+	assert.Error(t, err)
+
+	assert.Equal(t, []int{2, 3}, observed)
+}
+
+func TestRetry_Observer(t *testing.T) {
+	counter := 0
+	var attempts []int
+	var durations []time.Duration
+	var errs []error
+	failure := fmt.Errorf("oh snap this broke")
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		time.Sleep(10 * time.Millisecond)
+		if counter < 2 {
+			return failure
+		}
+		return nil
+	}, WithObserver(func(attempt int, duration time.Duration, err error) {
+		attempts = append(attempts, attempt)
+		durations = append(durations, duration)
+		errs = append(errs, err)
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, attempts)
+	assert.Equal(t, []error{failure, nil}, errs)
+	for _, d := range durations {
+		assert.GreaterOrEqual(t, d, 10*time.Millisecond)
+	}
+}
+
+func TestRetry_AttemptContext(t *testing.T) {
+	errBroken := errors.New("oh snap this broke")
+
+	var hooked []string
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		return errBroken
+	}, WithAttemptContext(), ErrorHook(func(err error) {
+		hooked = append(hooked, err.Error())
+	}))
+
+	unrecoverable := UnrecoverableError{}
+	assert.ErrorAs(t, err, &unrecoverable)
+	assert.EqualError(t, unrecoverable.Err, "attempt 3: oh snap this broke")
+	assert.ErrorIs(t, unrecoverable.Err, errBroken)
+	assert.Equal(t, []string{
+		"attempt 1: oh snap this broke",
+		"attempt 2: oh snap this broke",
+		"attempt 3: oh snap this broke",
+	}, hooked)
+}
+
+func TestRetry_DelayInterceptor(t *testing.T) {
+	counter := 0
+	var proposed []time.Duration
+	var attempts []int
+
+	start := time.Now()
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithDelayFunc(func(attempt int, err error) time.Duration {
+		return time.Duration(attempt) * 50 * time.Millisecond
+	}), WithDelayInterceptor(func(attempt int, d time.Duration, err error) time.Duration {
+		attempts = append(attempts, attempt)
+		proposed = append(proposed, d)
+		return d * 2
+	}))
+
+	assert.Error(t, err)
+	assert.Equal(t, 3, counter)
+	assert.Equal(t, []int{1, 2}, attempts)
+	assert.Equal(t, []time.Duration{50 * time.Millisecond, 100 * time.Millisecond}, proposed)
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestRetry_DelayInterceptorNegative(t *testing.T) {
+	counter := 0
+	start := time.Now()
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithDelayInterceptor(func(attempt int, d time.Duration, err error) time.Duration {
+		return -time.Hour
+	}))
+
+	assert.Error(t, err)
+	assert.Equal(t, 3, counter)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetry_MaxDelay(t *testing.T) {
+	var warned []int
+	start := time.Now()
+	err := Retry(SimpleRetryPolicy(6), func() error {
+		return fmt.Errorf("oh snap this broke")
+	}, WithDelayFunc(func(attempt int, err error) time.Duration {
+		return time.Duration(attempt) * 10 * time.Millisecond
+	}), WithMaxDelay(20*time.Millisecond), WithCapWarning(3, func(attempts int) {
+		warned = append(warned, attempts)
+	}))
+
+	assert.Error(t, err)
+	// Attempts 2 through 5 are followed by capped delays, the third of which is after attempt 4
+	assert.Equal(t, []int{4}, warned)
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	assert.Less(t, time.Since(start), 250*time.Millisecond)
+
+	assert.Panics(t, func() {
+		WithCapWarning(0, func(attempts int) {})
+	})
+	assert.Panics(t, func() {
+		WithCapWarning(-1, func(attempts int) {})
+	})
+}
+
+func TestRetry_MaxElapsedTime(t *testing.T) {
+	counter := 0
+	start := time.Now()
+	err := Retry(FixedRetryPolicy(100, 20*time.Millisecond), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithMaxElapsedTime(100*time.Millisecond))
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Less(t, counter, 10)
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestRetry_MaxElapsedTimeNextDelay(t *testing.T) {
+	counter := 0
+	start := time.Now()
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithDelayFunc(func(attempt int, err error) time.Duration {
+		return time.Second
+	}), WithMaxElapsedTime(500*time.Millisecond))
+
+	// Waiting for the second attempt would exceed the limit
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 1, counter)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	counter = 0
+	start = time.Now()
+	err = Retry(ExponentialBackoffRetryPolicy(5, 200*time.Millisecond, WithJitter(false)), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithMaxElapsedTime(500*time.Millisecond))
+
+	// Attempts at 0ms and 200ms, waiting another 400ms would exceed the limit
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 2, counter)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	counter = 0
+	start = time.Now()
+	err = Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithDelayFunc(func(attempt int, err error) time.Duration {
+		return math.MaxInt64
+	}), WithMaxElapsedTime(time.Second))
+
+	// The longest possible delay doesn't overflow the elapsed time
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 1, counter)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestRetry_WithMaxAttempts(t *testing.T) {
+	consulted := 0
+	counter := 0
+	err := Retry(func(err error) bool {
+		consulted++
+		return true
+	}, func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithMaxAttempts(4))
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 4, counter)
+	// The policy is not consulted once the cap is reached
+	assert.Equal(t, 3, consulted)
+
+	assert.Panics(t, func() {
+		WithMaxAttempts(0)
+	})
+}
+
+func TestRetry_WithResetOn(t *testing.T) {
+	var delays []time.Duration
+	errTimeout, errRefused := errors.New("timeout"), errors.New("connection refused")
+	counter := 0
+	err := Retry(ExponentialBackoffRetryPolicy(7, 10*time.Millisecond, WithJitter(false)), func() error {
+		counter++
+		// timeout, timeout, refused, refused, timeout, timeout, refused
+		if (counter+1)/2%2 == 1 {
+			return errTimeout
+		}
+		return errRefused
+	}, WithResetOn(func(prev, cur error) bool {
+		return !errors.Is(cur, prev)
+	}), OnRetry(func(attempt int, err error, nextDelay time.Duration) {
+		delays = append(delays, nextDelay)
+	}))
+
+	assert.ErrorIs(t, err, errRefused)
+	// The attempts made before a reset still count
+	assert.Equal(t, 7, counter)
+	assert.Equal(t, []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+	}, delays)
+
+	assert.Panics(t, func() {
+		WithResetOn(nil)
+	})
+}
+
+func TestRetryPolicy_ResetDelay(t *testing.T) {
+	policy := ExponentialBackoffRetryPolicy(4, 10*time.Millisecond, WithJitter(false))
+	var delays []time.Duration
+	for _, resetDelay := range []bool{false, false, true} {
+		c := consultation{err: errFailed, resetDelay: resetDelay}
+		assert.True(t, policy(&c))
+		delays = append(delays, c.delay)
+	}
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 10 * time.Millisecond}, delays)
+	// The attempts made before the reset still count
+	assert.False(t, policy(&consultation{err: errFailed}))
+}
+
+func TestRetry_StopOnRepeatedError(t *testing.T) {
+	counter := 0
+	err := Retry(SimpleRetryPolicy(10), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithStopOnRepeatedError(3), WithAttemptContext())
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.EqualError(t, err, "max retries exceeded: attempt 3: oh snap this broke (first error: attempt 1: oh snap this broke)")
+	assert.Equal(t, 3, counter)
+
+	assert.Panics(t, func() {
+		WithStopOnRepeatedError(1)
+	})
+}
+
+func TestRetry_StopOnRepeatedErrorReset(t *testing.T) {
+	sentinel := errors.New("sentinel")
+	counter := 0
+	err := Retry(SimpleRetryPolicy(10), func() error {
+		counter++
+		// sentinel, sentinel, other, sentinel, sentinel, sentinel
+		if counter == 3 {
+			return errors.New("something else")
+		}
+		return fmt.Errorf("query failed: %w", sentinel)
+	}, WithStopOnRepeatedError(3))
+
+	assert.ErrorIs(t, err, sentinel)
+	assert.Equal(t, 6, counter)
+}
+
+func TestRetry_WithDeadline(t *testing.T) {
+	deadline := time.Now().Add(300 * time.Millisecond)
+	counter := 0
+	err := Retry(FixedRetryPolicy(100, 20*time.Millisecond), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithDeadline(deadline))
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Greater(t, counter, 1)
+	assert.InDelta(t, 0, time.Until(deadline).Seconds(), 0.05)
+}
+
+func TestRetry_WithDeadlineNextDelay(t *testing.T) {
+	deadline := time.Now().Add(300 * time.Millisecond)
+	counter := 0
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithDelayFunc(func(attempt int, err error) time.Duration {
+		return 200 * time.Millisecond
+	}), WithDeadline(deadline))
+
+	// Waiting for the third attempt would overshoot the deadline
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 2, counter)
+	assert.True(t, time.Now().Before(deadline))
+}
+
+func TestRetry_WithDeadlinePolicyDelay(t *testing.T) {
+	deadline := time.Now().Add(100 * time.Millisecond)
+	counter := 0
+	err := Retry(FixedRetryPolicy(3, time.Second), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	}, WithDeadline(deadline))
+
+	// The delay of the policy would overshoot the deadline, so it isn't waited
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 1, counter)
+	assert.True(t, time.Now().Before(deadline))
+}
+
+func TestRetry_CapWarningBelowThreshold(t *testing.T) {
+	warned := false
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		return fmt.Errorf("oh snap this broke")
+	}, WithDelayFunc(func(attempt int, err error) time.Duration {
+		return time.Millisecond
+	}), WithMaxDelay(time.Millisecond), WithCapWarning(3, func(attempts int) {
+		warned = true
+	}))
+
+	assert.Error(t, err)
+	assert.False(t, warned)
+}
+
+func TestWeightedRetryPolicy(t *testing.T) {
+	light := fmt.Errorf("light")
+	heavy := fmt.Errorf("heavy")
+	weigh := func(err error) float64 {
+		if err == heavy {
+			return 5
+		}
+		return 1
+	}
+
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "light errors", err: light, expected: 10},
+		{name: "heavy errors", err: heavy, expected: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counter := 0
+			err := Retry(WeightedRetryPolicy(10, weigh, nil), func() error {
+				counter++
+				return test.err
+			})
+			assert.Error(t, err)
+			assert.Equal(t, test.expected, counter)
+		})
+	}
+}
+
+func TestWeightedRetryPolicy_Mixed(t *testing.T) {
+	light := fmt.Errorf("light")
+	heavy := fmt.Errorf("heavy")
+	weigh := func(err error) float64 {
+		if err == heavy {
+			return 5
+		}
+		return 1
+	}
+
+	var delays []int
+	counter := 0
+	err := Retry(WeightedRetryPolicy(10, weigh, func(attempt int) time.Duration {
+		delays = append(delays, attempt)
+		return time.Millisecond
+	}), func() error {
+		counter++
+		if counter%2 == 0 {
+			return heavy
+		}
+		return light
+	})
+
+	// light(1) + heavy(6) + light(7) + heavy(12)
+	assert.Error(t, err)
+	assert.Equal(t, 4, counter)
+	assert.Equal(t, []int{1, 2, 3}, delays)
+}
+
+func TestWeightedRetryPolicy_ContextCanceled(t *testing.T) {
+	policy := WeightedRetryPolicy(10, func(err error) float64 { return 1 }, nil)
+	assert.False(t, policy(context.Canceled))
+}
+
+func TestRetry_InitialDelay(t *testing.T) {
+	var firstAttempt time.Duration
+	start := time.Now()
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		firstAttempt = time.Since(start)
+		return nil
+	}, WithInitialDelay(200*time.Millisecond))
+
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, firstAttempt, 200*time.Millisecond)
+}
+
+func TestRetry_InitialDelayContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	counter := 0
+	start := time.Now()
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return nil
+	}, WithContext(ctx), WithInitialDelay(5*time.Second))
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, counter)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetry_ContextCanceledBetweenAttempts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	counter := 0
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		if counter == 2 {
+			cancel()
+		}
+		return fmt.Errorf("oh snap this broke")
+	}, WithContext(ctx))
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 2, counter)
+}
+
+func TestRetryContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	counter := 0
+	start := time.Now()
+	err := RetryContext(ctx, FixedRetryPolicy(3, 5*time.Second), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, counter)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetry_WithContextPolicyDelays(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+	}{
+		{name: "fixed", policy: FixedRetryPolicy(3, time.Hour)},
+		{name: "exponential", policy: ExponentialBackoffRetryPolicy(3, time.Hour)},
+		{name: "capped exponential", policy: CappedExponentialBackoffRetryPolicy(3, time.Hour, 2*time.Hour)},
+		{name: "fibonacci", policy: FibonacciBackoffRetryPolicy(3, time.Hour)},
+		{name: "decorrelated jitter", policy: DecorrelatedJitterRetryPolicy(3, time.Hour, 2*time.Hour)},
+		{name: "backoff", policy: BackoffRetryPolicy(WithMaxAttemptsBackoff(NewFixedBackoff(time.Hour), 3))},
+		{name: "weighted", policy: WeightedRetryPolicy(3, func(error) float64 { return 1 }, func(int) time.Duration { return time.Hour })},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			counter := 0
+			start := time.Now()
+			err := Retry(test.policy, func() error {
+				counter++
+				return fmt.Errorf("oh snap this broke")
+			}, WithContext(ctx))
+
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			assert.Equal(t, 1, counter)
+			assert.Less(t, time.Since(start), time.Second)
+		})
+	}
+}
+
+func TestRetryContext_Shutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	counter := 0
+	start := time.Now()
+	err := RetryContext(ctx, ExponentialBackoffRetryPolicy(10, time.Minute), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	// The long backoff is interrupted rather than slept out
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, counter)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetryContext_CanceledPolicyReused(t *testing.T) {
+	policy := FixedRetryPolicy(3, time.Hour)
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := RetryContext(ctx, policy, func() error {
+			cancel()
+			return errFailed
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+
+	// Nothing is left behind waiting out the delays of the policy
+	assert.LessOrEqual(t, runtime.NumGoroutine(), baseline)
+}
+
+func TestRetryContext_InitialDelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	counter := 0
+	start := time.Now()
+	err := RetryCtx(ctx, SimpleRetryPolicy(3), func(ctx context.Context) error {
+		counter++
+		return nil
+	}, WithInitialDelay(5*time.Second))
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, counter)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetryContext_AlreadyDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	counter := 0
+	err := RetryContext(ctx, SimpleRetryPolicy(3), func() error {
+		counter++
+		return nil
+	})
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, counter)
+}
+
+func TestRetryContext_Exhausted(t *testing.T) {
+	counter := 0
+	err := RetryContext(context.Background(), FixedRetryPolicy(3, time.Millisecond), func() error {
+		counter++
+		return fmt.Errorf("oh snap this broke")
+	})
+
+	var unrecoverable UnrecoverableError
+	assert.ErrorAs(t, err, &unrecoverable)
+	assert.Equal(t, 3, counter)
+}
+
+func TestRetryCtx(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+
+	counter := 0
+	err := RetryCtx(ctx, SimpleRetryPolicy(3), func(ctx context.Context) error {
+		counter++
+		assert.Equal(t, "value", ctx.Value(key{}))
+		if counter < 2 {
+			return fmt.Errorf("oh snap this broke")
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counter)
+}
+
+func TestRetryCtx_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	counter := 0
+	err := RetryCtx(ctx, SimpleRetryPolicy(5), func(ctx context.Context) error {
+		counter++
+		cancel()
+		return ctx.Err()
+	})
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, counter)
+}
+
+func TestRetryCtx_PerAttemptTimeout(t *testing.T) {
+	counter := 0
+	var hookErr error
+	err := RetryCtx(context.Background(), SimpleRetryPolicy(3), func(ctx context.Context) error {
+		counter++
+		if counter == 1 {
+			// The first attempt hangs until it is timed out
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}, WithPerAttemptTimeout(20*time.Millisecond), ErrorHook(func(err error) {
+		hookErr = err
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counter)
+	assert.ErrorIs(t, hookErr, context.DeadlineExceeded)
+}
+
+func TestRetryCtx_PerAttemptTimeoutOperationDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	counter := 0
+	start := time.Now()
+	err := RetryCtx(ctx, SimpleRetryPolicy(100), func(ctx context.Context) error {
+		counter++
+		<-ctx.Done()
+		return ctx.Err()
+	}, WithPerAttemptTimeout(time.Second))
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, counter)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestRunWithRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var backoffs []int
+	counter := 0
+	hookCounter := 0
+	err := RunWithRetry(ctx, func(ctx context.Context) error {
+		counter++
+		switch counter {
+		case 3:
+			// Success resets the backoff
+			return nil
+		case 6:
+			cancel()
+			return ctx.Err()
+		default:
+			return fmt.Errorf("connection lost")
+		}
+	}, func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	}, ErrorHook(func(err error) {
+		hookCounter++
+	}))
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 6, counter)
+	assert.Equal(t, 5, hookCounter)
+	assert.Equal(t, []int{1, 2, 1, 2}, backoffs)
+}
+
+func TestRunWithRetry_CanceledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := RunWithRetry(ctx, func(ctx context.Context) error {
+		return fmt.Errorf("connection lost")
+	}, func(attempt int) time.Duration {
+		return time.Hour
+	})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetryWithResource(t *testing.T) {
+	acquired := 0
+	released := 0
+	used := 0
+
+	err := RetryWithResource(SimpleRetryPolicy(5), func() (int, error) {
+		acquired++
+		if acquired == 2 {
+			return 0, fmt.Errorf("failed to acquire")
+		}
+		return acquired, nil
+	}, func(resource int) error {
+		used++
+		if resource < 4 {
+			return fmt.Errorf("oh snap this broke")
+		}
+		return nil
+	}, func(resource int) {
+		released++
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 4, acquired)
+	assert.Equal(t, 3, used)
+	assert.Equal(t, 3, released)
+}
+
+func TestRetryWithResource_Failure(t *testing.T) {
+	acquired := 0
+	released := 0
+
+	err := RetryWithResource(SimpleRetryPolicy(3), func() (string, error) {
+		acquired++
+		return "conn", nil
+	}, func(resource string) error {
+		return fmt.Errorf("oh snap this broke")
+	}, func(resource string) {
+		released++
+	})
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 3, acquired)
+	assert.Equal(t, 3, released)
+}
+
+func TestRetry_Recover(t *testing.T) {
+	counter := 0
+	var hookErr error
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		if counter == 1 {
+			var m map[string]int
+			m["boom"] = 1
+		}
+		return nil
+	}, WithRecover(), ErrorHook(func(err error) {
+		hookErr = err
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counter)
+	assert.ErrorContains(t, hookErr, "assignment to entry in nil map")
+	assert.ErrorContains(t, hookErr, "TestRetry_Recover")
+	var runtimeErr runtime.Error
+	assert.ErrorAs(t, hookErr, &runtimeErr)
+}
+
+func TestRetry_RecoverExhausted(t *testing.T) {
+	err := Retry(SimpleRetryPolicy(2), func() error {
+		panic("oh snap this broke")
+	}, WithRecover())
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.ErrorContains(t, err, "panic: oh snap this broke")
+}
+
+func TestRetry_PanicWithoutRecover(t *testing.T) {
+	assert.Panics(t, func() {
+		_ = Retry(SimpleRetryPolicy(2), func() error {
+			panic("oh snap this broke")
+		})
+	})
+}
+
+func TestRetry_WithoutWrap(t *testing.T) {
+	counter := 0
+	var last error
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		last = fmt.Errorf("failure %d", counter)
+		return last
+	}, WithoutWrap())
+
+	assert.Equal(t, last, err)
+	assert.EqualError(t, err, "failure 3")
+	assert.False(t, errors.As(err, &UnrecoverableError{}))
+}
+
+func TestRetry_CollectErrors(t *testing.T) {
+	counter := 0
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return fmt.Errorf("failure %d", counter)
+	}, CollectErrors())
+
+	unrecoverable := UnrecoverableError{}
+	assert.ErrorAs(t, err, &unrecoverable)
+	assert.Len(t, unrecoverable.Errs, 3)
+	assert.Equal(t, 0, unrecoverable.Dropped)
+	assert.EqualError(t, err, "max retries exceeded: failure 1; failure 2; failure 3")
+}
+
+func TestUnrecoverableError_Metadata(t *testing.T) {
+	sentinel := errors.New("sentinel")
+	err := Retry(FixedRetryPolicy(3, 10*time.Millisecond), func() error {
+		return fmt.Errorf("query failed: %w", sentinel)
+	})
+
+	assert.True(t, errors.Is(err, sentinel))
+	assert.True(t, errors.Is(err, ErrRetriesExhausted))
+	unrecoverable := UnrecoverableError{}
+	assert.ErrorAs(t, err, &unrecoverable)
+	assert.Equal(t, 3, unrecoverable.Attempts())
+	assert.GreaterOrEqual(t, unrecoverable.Elapsed(), 20*time.Millisecond)
+}
+
+func TestRetry_CollectErrorsUnwrap(t *testing.T) {
+	failures := []error{errors.New("first"), errors.New("second"), errors.New("third")}
+	counter := 0
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return failures[counter-1]
+	}, CollectErrors())
+
+	for _, failure := range failures {
+		assert.ErrorIs(t, err, failure)
+	}
+	unrecoverable := UnrecoverableError{}
+	assert.ErrorAs(t, err, &unrecoverable)
+	assert.Equal(t, failures, unrecoverable.Errs)
+}
+
+func TestRetry_ErrorHistoryLimit(t *testing.T) {
+	counter := 0
+	err := Retry(SimpleRetryPolicy(8), func() error {
+		counter++
+		return fmt.Errorf("failure %d", counter)
+	}, WithErrorHistoryLimit(3))
+
+	unrecoverable := UnrecoverableError{}
+	assert.ErrorAs(t, err, &unrecoverable)
+	assert.Equal(t, 8, counter)
+	assert.Equal(t, 5, unrecoverable.Dropped)
+	assert.EqualError(t, unrecoverable.Err, "failure 8")
+	assert.EqualError(t, err, "max retries exceeded: failure 6; failure 7; failure 8 (5 earlier errors dropped)")
+}
+
+type cancelledError struct{}
+
+func (cancelledError) Error() string {
+	return "operation cancelled by framework"
+}
+
+func TestRetry_ContextErrorMatcher(t *testing.T) {
+	counter := 0
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		return cancelledError{}
+	}, WithContext(context.Background()), WithContextErrorMatcher(func(err error) bool {
+		return errors.As(err, &cancelledError{})
+	}))
+
+	var abandoned AbandonedError
+	assert.ErrorAs(t, err, &abandoned)
+	assert.Equal(t, ReasonCanceled, abandoned.Reason)
+	assert.Equal(t, 1, counter)
+}
+
+func TestRetry_ContextErrorMatcherDefault(t *testing.T) {
+	counter := 0
+	err := Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		return fmt.Errorf("request failed: %w", context.DeadlineExceeded)
+	}, WithContext(context.Background()))
+
+	assert.ErrorAs(t, err, &AbandonedError{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, counter)
+
+	counter = 0
+	err = Retry(SimpleRetryPolicy(5), func() error {
+		counter++
+		return cancelledError{}
+	}, WithContext(context.Background()))
+
+	assert.Error(t, err)
+	assert.Equal(t, 5, counter)
+}
+
+func TestRetry_ReusedStateIsolated(t *testing.T) {
+	failing := func(msg string) Retryable {
+		return func() error {
+			return errors.New(msg)
+		}
+	}
+
+	first := UnrecoverableError{}
+	err := Retry(SimpleRetryPolicy(2), failing("first"), CollectErrors())
+	assert.ErrorAs(t, err, &first)
+
+	second := UnrecoverableError{}
+	err = Retry(SimpleRetryPolicy(2), failing("second"), CollectErrors())
+	assert.ErrorAs(t, err, &second)
+
+	third := UnrecoverableError{}
+	err = Retry(SimpleRetryPolicy(2), failing("third"))
+	assert.ErrorAs(t, err, &third)
+
+	assert.EqualError(t, first, "max retries exceeded: first; first")
+	assert.EqualError(t, second, "max retries exceeded: second; second")
+	assert.Nil(t, third.Errs)
+}
+
+func TestRetryWithAttempt(t *testing.T) {
+	var attempts []int
+	err := RetryWithAttempt(SimpleRetryPolicy(5), func(attempt int) error {
+		attempts = append(attempts, attempt)
+		if attempt < 3 {
+			return errFailed
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+
+	attempts = nil
+	err = RetryWithAttempt(SimpleRetryPolicy(2), func(attempt int) error {
+		attempts = append(attempts, attempt)
+		return errFailed
+	})
+	assert.ErrorIs(t, err, errFailed)
+	assert.Equal(t, []int{1, 2}, attempts)
+
+	assert.Panics(t, func() {
+		_ = RetryWithAttempt(SimpleRetryPolicy(2), nil)
+	})
+}
+
+func TestRetryWithResult(t *testing.T) {
+	counter := 0
+	hookCalls := 0
+	value, err := RetryWithResult(SimpleRetryPolicy(3), func() (int, error) {
+		counter++
+		if counter < 2 {
+			return 1, fmt.Errorf("oh snap this broke")
+		}
+		return 42, nil
+	}, ErrorHook(func(err error) {
+		hookCalls++
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 42, value)
+	assert.Equal(t, 2, counter)
+	assert.Equal(t, 1, hookCalls)
+}
+
+func TestRetryWithResult_Failure(t *testing.T) {
+	value, err := RetryWithResult(SimpleRetryPolicy(3), func() (int, error) {
+		return 1, fmt.Errorf("oh snap this broke")
+	})
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Zero(t, value)
+}
+
+func TestRetryWithResult2(t *testing.T) {
+	counter := 0
+	value, meta, err := RetryWithResult2(SimpleRetryPolicy(3), func() (string, int, error) {
+		counter++
+		if counter < 2 {
+			return "partial", 1, fmt.Errorf("oh snap this broke")
+		}
+		return "value", 42, nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.Equal(t, 42, meta)
+	assert.Equal(t, 2, counter)
+}
+
+func TestRetryWithResult2_Failure(t *testing.T) {
+	value, meta, err := RetryWithResult2(SimpleRetryPolicy(3), func() (string, int, error) {
+		return "partial", 1, fmt.Errorf("oh snap this broke")
+	})
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Zero(t, value)
+	assert.Zero(t, meta)
+}
+
+func TestRetryWithResult3(t *testing.T) {
+	counter := 0
+	a, b, c, err := RetryWithResult3(SimpleRetryPolicy(3), func() (int, string, bool, error) {
+		counter++
+		if counter < 3 {
+			return 0, "", false, fmt.Errorf("oh snap this broke")
+		}
+		return 1, "two", true, nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, a)
+	assert.Equal(t, "two", b)
+	assert.True(t, c)
+}
+
+func TestRetryWithResult3_Failure(t *testing.T) {
+	a, b, c, err := RetryWithResult3(SimpleRetryPolicy(3), func() (int, string, bool, error) {
+		return 1, "two", true, fmt.Errorf("oh snap this broke")
+	})
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Zero(t, a)
+	assert.Zero(t, b)
+	assert.False(t, c)
+}
+
+func BenchmarkExponentialBase(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_ = exponentialBase(100*time.Millisecond, i%20)
+	}
+}
+
+func BenchmarkRetry_Success(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = Retry(SimpleRetryPolicy(3), func() error {
+			return nil
+		})
+	}
+}
+
+func BenchmarkRetry_Exhausted(b *testing.B) {
+	failure := fmt.Errorf("oh snap this broke")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = Retry(SimpleRetryPolicy(3), func() error {
+			return failure
+		})
+	}
+}
+
+func BenchmarkRetry_WithHooks(b *testing.B) {
+	failure := fmt.Errorf("oh snap this broke")
+	hook := ErrorHook(func(err error) {})
+	interceptor := WithDelayInterceptor(func(attempt int, d time.Duration, err error) time.Duration {
+		return d
+	})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = Retry(SimpleRetryPolicy(3), func() error {
+			return failure
+		}, hook, interceptor)
+	}
+}
+
+type throttledError struct {
+	after time.Duration
+}
+
+func (t throttledError) Error() string {
+	return "too many requests"
+}
+
+func (t throttledError) RetryAfter() time.Duration {
+	return t.after
+}
+
+type leaseError struct {
+	expires time.Time
+}
+
+func (l leaseError) Error() string {
+	return "lease unavailable"
+}
+
+func (l leaseError) RetryDeadline() time.Time {
+	return l.expires
+}
+
+func TestRetry_RetryAfterCarrier(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		opts   []Option
+	}{
+		{name: "fixed", policy: FixedRetryPolicy(3, time.Hour)},
+		{name: "exponential", policy: ExponentialBackoffRetryPolicy(3, time.Hour)},
+		{name: "backoff", policy: BackoffRetryPolicy(WithMaxAttemptsBackoff(NewFixedBackoff(time.Hour), 3))},
+		{name: "weighted", policy: WeightedRetryPolicy(3, func(error) float64 { return 1 }, func(int) time.Duration { return time.Hour })},
+		{name: "delay func", policy: SimpleRetryPolicy(3), opts: []Option{WithDelayFunc(func(int, error) time.Duration { return time.Hour })}},
+		{name: "simple", policy: SimpleRetryPolicy(3)},
+		{name: "custom", policy: func(error) bool { return true }, opts: []Option{WithMaxAttempts(3)}},
+		{name: "and", policy: And(FixedRetryPolicy(3, time.Hour), ExponentialBackoffRetryPolicy(3, time.Hour))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counter := 0
+			start := time.Now()
+			err := Retry(test.policy, func() error {
+				counter++
+				return throttledError{after: 20 * time.Millisecond}
+			}, test.opts...)
+
+			assert.Error(t, err)
+			assert.Equal(t, 3, counter)
+			assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+			assert.Less(t, time.Since(start), time.Second)
+		})
+	}
+}
+
+func TestRetry_DeadlineCarrier(t *testing.T) {
+	expires := time.Now().Add(250 * time.Millisecond)
+	counter := 0
+	err := Retry(SimpleRetryPolicy(100), func() error {
+		counter++
+		return fmt.Errorf("acquire failed: %w", leaseError{expires: expires})
+	}, WithDelayFunc(func(attempt int, err error) time.Duration {
+		return 100 * time.Millisecond
+	}))
+
+	// Attempts at 0ms, 100ms and 200ms, waiting another 100ms would exceed the
+	// deadline.
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 3, counter)
+	assert.True(t, time.Now().Before(expires))
+}
+
+func TestRetry_DeadlineCarrierExpired(t *testing.T) {
+	counter := 0
+	err := Retry(SimpleRetryPolicy(100), func() error {
+		counter++
+		return leaseError{expires: time.Now().Add(-time.Second)}
+	})
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 1, counter)
+}
+
+func TestRetry_DeadlineCarrierZero(t *testing.T) {
+	counter := 0
+	err := Retry(SimpleRetryPolicy(3), func() error {
+		counter++
+		return leaseError{}
+	})
+
+	assert.ErrorAs(t, err, &UnrecoverableError{})
+	assert.Equal(t, 3, counter)
 }
@@ -0,0 +1,21 @@
+module github.com/jkratz55/riprovare/riprovaregrpc
+
+go 1.20
+
+require (
+	github.com/jkratz55/riprovare v0.0.0-20261014172656-0e959e9c2a8b
+	github.com/stretchr/testify v1.8.1
+	google.golang.org/grpc v1.58.3
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/net v0.12.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,114 @@
+// Package riprovaregrpc provides gRPC client interceptors retrying calls using
+// the policies of riprovare. It is a module of its own, so only programs using
+// it depend on gRPC. It requires a published version of riprovare, to test it
+// against a local copy use a go.work file including both modules.
+package riprovaregrpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jkratz55/riprovare"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultCodes are the codes IsRetryable considers worth retrying.
+var defaultCodes = []codes.Code{codes.Unavailable, codes.ResourceExhausted}
+
+// IsRetryable reports whether err is a gRPC status error with a code that is
+// worth retrying, which are Unavailable and ResourceExhausted. The interceptors
+// of this package only retry these errors unless configured otherwise using
+// RetryOn or riprovare.RetryIf.
+func IsRetryable(err error) bool {
+	return hasCode(err, defaultCodes)
+}
+
+// RetryOn is a riprovare.Option only retrying gRPC status errors with one of the
+// provided codes, any other error stops retries immediately. It configures
+// riprovare.RetryIf, so it composes with any RetryPolicy and can be used with
+// both the interceptors of this package and the functions of riprovare. For
+// example, to also retry attempts that timed out:
+//
+//	RetryOn(codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded)
+//
+// Calling RetryOn without codes will cause a panic.
+func RetryOn(retryable ...codes.Code) riprovare.Option {
+	if len(retryable) == 0 {
+		panic(fmt.Errorf("illegal use of api: at least one code is required"))
+	}
+	retryable = append([]codes.Code(nil), retryable...)
+	return riprovare.RetryIf(func(err error) bool {
+		return hasCode(err, retryable)
+	})
+}
+
+func hasCode(err error, retryable []codes.Code) bool {
+	if err == nil {
+		return false
+	}
+	code := status.Code(err)
+	for _, c := range retryable {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// UnaryClientInterceptor returns a grpc.UnaryClientInterceptor retrying unary
+// calls that fail with an error IsRetryable reports as retryable. Every attempt
+// is made with the Context of the call, so the retries stop once it is done,
+// and riprovare.WithPerAttemptTimeout limits the duration of each attempt, which
+// is only retried if DeadlineExceeded is configured using RetryOn.
+// Because the interceptor is shared by all calls newPolicy is invoked to create
+// a fresh RetryPolicy for every call. The Options are applied to every call, a
+// classifier passed using RetryOn or riprovare.RetryIf replaces IsRetryable.
+//
+// A nil newPolicy will cause a panic.
+func UnaryClientInterceptor(newPolicy func() riprovare.RetryPolicy, opts ...riprovare.Option) grpc.UnaryClientInterceptor {
+	if newPolicy == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	opts = withDefaults(opts)
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		return riprovare.RetryCtx(ctx, newPolicy(), func(ctx context.Context) error {
+			return invoker(ctx, method, req, reply, cc, callOpts...)
+		}, opts...)
+	}
+}
+
+// StreamClientInterceptor returns a grpc.StreamClientInterceptor retrying the
+// creation of streams that fails with an error IsRetryable reports as
+// retryable. Only establishing the stream is retried, messages are not replayed
+// once the stream has been created. Because the stream outlives the attempt
+// creating it, every attempt is made with the Context of the call and
+// riprovare.WithPerAttemptTimeout has no effect. Otherwise the interceptor
+// behaves like UnaryClientInterceptor.
+//
+// A nil newPolicy will cause a panic.
+func StreamClientInterceptor(newPolicy func() riprovare.RetryPolicy, opts ...riprovare.Option) grpc.StreamClientInterceptor {
+	if newPolicy == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	opts = withDefaults(opts)
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		var stream grpc.ClientStream
+		err := riprovare.RetryContext(ctx, newPolicy(), func() error {
+			var err error
+			stream, err = streamer(ctx, desc, cc, method, callOpts...)
+			return err
+		}, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+}
+
+// withDefaults prepends the default classification to opts, so a classifier
+// passed by the caller takes precedence.
+func withDefaults(opts []riprovare.Option) []riprovare.Option {
+	return append([]riprovare.Option{riprovare.RetryIf(IsRetryable)}, opts...)
+}
@@ -0,0 +1,157 @@
+package riprovaregrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jkratz55/riprovare"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newPolicy() riprovare.RetryPolicy {
+	return riprovare.FixedRetryPolicy(3, time.Millisecond)
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, IsRetryable(status.Error(codes.Unavailable, "unavailable")))
+	assert.True(t, IsRetryable(status.Error(codes.ResourceExhausted, "exhausted")))
+	assert.False(t, IsRetryable(status.Error(codes.InvalidArgument, "invalid")))
+	assert.False(t, IsRetryable(errors.New("boom")))
+	assert.False(t, IsRetryable(nil))
+}
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	interceptor := UnaryClientInterceptor(newPolicy)
+
+	counter := 0
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		counter++
+		if counter < 3 {
+			return status.Error(codes.Unavailable, "unavailable")
+		}
+		return nil
+	}
+	err := interceptor(context.Background(), "/test.Service/Method", nil, nil, nil, invoker)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, counter)
+
+	counter = 0
+	invoker = func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		counter++
+		return status.Error(codes.InvalidArgument, "invalid")
+	}
+	err = interceptor(context.Background(), "/test.Service/Method", nil, nil, nil, invoker)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, 1, counter)
+
+	assert.Panics(t, func() {
+		UnaryClientInterceptor(nil)
+	})
+}
+
+func TestUnaryClientInterceptor_RetryIf(t *testing.T) {
+	interceptor := UnaryClientInterceptor(newPolicy, riprovare.RetryIf(func(err error) bool {
+		return status.Code(err) == codes.Aborted
+	}))
+
+	counter := 0
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		counter++
+		return status.Error(codes.Aborted, "aborted")
+	}
+	err := interceptor(context.Background(), "/test.Service/Method", nil, nil, nil, invoker)
+	assert.ErrorIs(t, err, riprovare.ErrRetriesExhausted)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Equal(t, 3, counter)
+}
+
+func TestRetryOn(t *testing.T) {
+	interceptor := UnaryClientInterceptor(newPolicy,
+		RetryOn(codes.Unavailable, codes.DeadlineExceeded),
+		riprovare.WithPerAttemptTimeout(10*time.Millisecond))
+
+	counter := 0
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		counter++
+		if counter < 3 {
+			<-ctx.Done()
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		return status.Error(codes.PermissionDenied, "denied")
+	}
+	err := interceptor(context.Background(), "/test.Service/Method", nil, nil, nil, invoker)
+	var abandoned riprovare.AbandonedError
+	assert.ErrorAs(t, err, &abandoned)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, 3, counter)
+
+	counter = 0
+	err = riprovare.Retry(riprovare.SimpleRetryPolicy(5), func() error {
+		counter++
+		return status.Error(codes.ResourceExhausted, "exhausted")
+	}, RetryOn(codes.Unavailable))
+	assert.ErrorAs(t, err, &abandoned)
+	assert.Equal(t, 1, counter)
+
+	assert.Panics(t, func() {
+		RetryOn()
+	})
+}
+
+func TestUnaryClientInterceptor_ContextDone(t *testing.T) {
+	interceptor := UnaryClientInterceptor(func() riprovare.RetryPolicy {
+		return riprovare.FixedRetryPolicy(100, time.Second)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+
+	start := time.Now()
+	err := interceptor(ctx, "/test.Service/Method", nil, nil, nil, invoker)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+type fakeStream struct {
+	grpc.ClientStream
+}
+
+func TestStreamClientInterceptor(t *testing.T) {
+	interceptor := StreamClientInterceptor(newPolicy)
+
+	counter := 0
+	want := &fakeStream{}
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		counter++
+		if counter < 2 {
+			return nil, status.Error(codes.Unavailable, "unavailable")
+		}
+		return want, nil
+	}
+	stream, err := interceptor(context.Background(), &grpc.StreamDesc{}, nil, "/test.Service/Stream", streamer)
+	assert.NoError(t, err)
+	assert.Same(t, want, stream)
+	assert.Equal(t, 2, counter)
+
+	counter = 0
+	streamer = func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		counter++
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	stream, err = interceptor(context.Background(), &grpc.StreamDesc{}, nil, "/test.Service/Stream", streamer)
+	assert.Nil(t, stream)
+	assert.ErrorIs(t, err, riprovare.ErrRetriesExhausted)
+	assert.Equal(t, 3, counter)
+
+	assert.Panics(t, func() {
+		StreamClientInterceptor(nil)
+	})
+}
@@ -0,0 +1,148 @@
+// Package riprovarehttp provides an http.RoundTripper retrying requests using
+// the policies of riprovare, giving any http.Client transparent retries.
+package riprovarehttp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jkratz55/riprovare"
+)
+
+// Transport is an http.RoundTripper retrying requests sent through another
+// http.RoundTripper using riprovare.DoHTTP. Requests are retried if they fail to
+// be sent or the response has a retryable status code, the responses of failed
+// attempts are drained and closed, and retries stop once the Context of the
+// request is done. Once the retries are exhausted the response of the final
+// attempt is returned, like any http.RoundTripper returns the responses it
+// obtained regardless of their status code. Its body is limited to the part
+// DoHTTP drained, at most 4 KiB.
+//
+// Only requests that are safe to repeat are retried. These are requests with
+// the idempotent methods GET, HEAD, OPTIONS, TRACE, PUT and DELETE and, as with
+// http.Transport, requests with an Idempotency-Key or X-Idempotency-Key header.
+// Any other request is sent once without retries.
+//
+// A Transport is safe for concurrent use.
+type Transport struct {
+	base      http.RoundTripper
+	client    *http.Client
+	newPolicy func() riprovare.RetryPolicy
+	opts      []riprovare.Option
+}
+
+// NewTransport returns a Transport sending requests through rt, or
+// http.DefaultTransport if rt is nil. Because a Transport is shared by all the
+// requests of a client newPolicy is invoked to create a fresh RetryPolicy for
+// every request. The Options are applied to every request, for example
+// riprovare.WithRetryableStatusCodes changes which responses are retried.
+//
+// A nil newPolicy will cause a panic.
+func NewTransport(rt http.RoundTripper, newPolicy func() riprovare.RetryPolicy, opts ...riprovare.Option) *Transport {
+	if newPolicy == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &Transport{
+		base: rt,
+		// The client only adapts rt for DoHTTP, redirects are left to the client
+		// using the Transport.
+		client: &http.Client{
+			Transport: recordingTransport{base: rt},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		newPolicy: newPolicy,
+		opts:      opts,
+	}
+}
+
+// RoundTrip implements http.RoundTripper. A request that is not safe to repeat
+// or has a body that cannot be rewound, because GetBody is nil, is sent once
+// without retries.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req) || req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return t.base.RoundTrip(req)
+	}
+	res, err := riprovare.DoHTTP(req.Context(), t.client, req, t.newPolicy(), t.opts...)
+	if err == nil {
+		// The body of a response that is returned as is was never read
+		if body, ok := res.Body.(*recordedBody); ok {
+			res.Body = body.ReadCloser
+		}
+		return res, nil
+	}
+	if res := finalResponse(err); res != nil {
+		return res, nil
+	}
+	return nil, err
+}
+
+// finalResponse returns the response of the final attempt if Retry stopped
+// because of its status code, with the body DoHTTP drained restored.
+func finalResponse(err error) *http.Response {
+	var unrecoverable riprovare.UnrecoverableError
+	var abandoned riprovare.AbandonedError
+	if errors.As(err, &unrecoverable) {
+		err = unrecoverable.Err
+	} else if errors.As(err, &abandoned) {
+		err = abandoned.Err
+	}
+	var statusErr *riprovare.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Response == nil {
+		return nil
+	}
+	res := statusErr.Response
+	if body, ok := res.Body.(*recordedBody); ok {
+		res.Body = io.NopCloser(bytes.NewReader(body.buf.Bytes()))
+	}
+	return res
+}
+
+// idempotent reports if req can be sent again without side effects, following
+// the rules http.Transport applies to retrying requests.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	if !ok {
+		_, ok = req.Header["X-Idempotency-Key"]
+	}
+	return ok
+}
+
+// recordingTransport keeps a copy of the response bodies read while DoHTTP
+// drains the responses of failed attempts, so the response of the final
+// attempt can still be returned.
+type recordingTransport struct {
+	base http.RoundTripper
+}
+
+func (r recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := r.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = &recordedBody{ReadCloser: res.Body}
+	return res, nil
+}
+
+// recordedBody is a response body keeping a copy of everything read from it.
+type recordedBody struct {
+	io.ReadCloser
+	buf bytes.Buffer
+}
+
+func (r *recordedBody) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.Write(p[:n])
+	return n, err
+}
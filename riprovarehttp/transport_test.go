@@ -0,0 +1,150 @@
+package riprovarehttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jkratz55/riprovare"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPolicy() riprovare.RetryPolicy {
+	return riprovare.FixedRetryPolicy(3, time.Millisecond)
+}
+
+func TestTransport(t *testing.T) {
+	var calls int32
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("payload"))
+	client := &http.Client{Transport: NewTransport(nil, newPolicy)}
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, int32(3), calls)
+	assert.Equal(t, []string{"payload", "payload", "payload"}, bodies)
+}
+
+func TestTransport_Exhausted(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = io.WriteString(w, "upstream unavailable")
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewTransport(http.DefaultTransport, newPolicy)}
+	res, err := client.Get(server.URL)
+
+	// The response of the final attempt is returned, including its body
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+	assert.Equal(t, "upstream unavailable", string(body))
+	assert.Equal(t, int32(3), calls)
+}
+
+func TestTransport_NonIdempotent(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewTransport(nil, newPolicy)}
+	res, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, int32(1), calls)
+
+	// An idempotency key makes the request safe to repeat
+	req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("payload"))
+	req.Header.Set("Idempotency-Key", "a1b2c3")
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, int32(4), calls)
+}
+
+func TestTransport_Options(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	transport := NewTransport(nil, newPolicy, riprovare.WithRetryableStatusCodes(http.StatusTooManyRequests))
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestTransport_Canceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	client := &http.Client{Transport: NewTransport(nil, func() riprovare.RetryPolicy {
+		return riprovare.FixedRetryPolicy(100, time.Second)
+	})}
+
+	start := time.Now()
+	_, err := client.Do(req)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestTransport_BodyWithoutGetBody(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL, io.NopCloser(strings.NewReader("payload")))
+	client := &http.Client{Transport: NewTransport(nil, newPolicy)}
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestNewTransport_NilPolicy(t *testing.T) {
+	assert.Panics(t, func() {
+		NewTransport(nil, nil)
+	})
+}
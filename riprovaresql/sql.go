@@ -0,0 +1,130 @@
+// Package riprovaresql provides helpers retrying database/sql operations that
+// failed with transient errors using the policies of riprovare.
+package riprovaresql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/jkratz55/riprovare"
+)
+
+// Execer executes statements, implemented by *sql.DB and *sql.Conn.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Queryer executes queries, implemented by *sql.DB and *sql.Conn.
+type Queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// TxBeginner starts transactions, implemented by *sql.DB and *sql.Conn.
+type TxBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// transientSQLStates are the SQLSTATE codes of transactions that were rolled
+// back because of concurrent transactions, serialization_failure and
+// deadlock_detected, which succeed when the transaction is run again.
+var transientSQLStates = map[string]bool{
+	"40001": true,
+	"40P01": true,
+}
+
+// IsTransient reports whether err is worth retrying, which is the case for
+// driver.ErrBadConn and errors of drivers reporting a serialization failure or
+// deadlock through a SQLState() string method, as the errors of pgx and lib/pq
+// do. Other drivers can be supported by passing a classifier using
+// riprovare.RetryIf.
+func IsTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var stateErr interface{ SQLState() string }
+	return errors.As(err, &stateErr) && transientSQLStates[stateErr.SQLState()]
+}
+
+// ExecWithRetry executes a statement using db and retries it according to the
+// RetryPolicy while it fails with an error IsTransient reports as transient.
+// Every attempt is made with ctx, so the retries stop once ctx is done. The
+// statement may be executed more than once, so it should be idempotent, and it
+// should not be executed within a transaction, use TxWithRetry instead. The
+// Options are applied to the retries, a classifier passed using
+// riprovare.RetryIf replaces IsTransient.
+//
+// A nil Context, Execer or RetryPolicy will cause a panic.
+func ExecWithRetry(ctx context.Context, db Execer, policy riprovare.RetryPolicy, query string, args []any, opts ...riprovare.Option) (sql.Result, error) {
+	if db == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil Execer"))
+	}
+	opts = append([]riprovare.Option{riprovare.RetryIf(IsTransient)}, opts...)
+	var res sql.Result
+	err := riprovare.RetryCtx(ctx, policy, func(ctx context.Context) error {
+		var err error
+		res, err = db.ExecContext(ctx, query, args...)
+		return err
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// QueryWithRetry executes a query using db and retries it according to the
+// RetryPolicy while it fails with an error IsTransient reports as transient.
+// Only executing the query is retried, errors reading the rows are not. Every
+// attempt is made with ctx, so the retries stop once ctx is done. The Options
+// are applied to the retries, a classifier passed using riprovare.RetryIf
+// replaces IsTransient.
+//
+// A nil Context, Queryer or RetryPolicy will cause a panic.
+func QueryWithRetry(ctx context.Context, db Queryer, policy riprovare.RetryPolicy, query string, args []any, opts ...riprovare.Option) (*sql.Rows, error) {
+	if db == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil Queryer"))
+	}
+	opts = append([]riprovare.Option{riprovare.RetryIf(IsTransient)}, opts...)
+	var rows *sql.Rows
+	err := riprovare.RetryCtx(ctx, policy, func(ctx context.Context) error {
+		var err error
+		rows, err = db.QueryContext(ctx, query, args...)
+		return err
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// TxWithRetry runs fn in a transaction started using db and commits it if fn
+// returns nil. If fn or committing fails the transaction is rolled back and,
+// while the error is reported as transient by IsTransient, the whole transaction
+// is run again according to the RetryPolicy, so fn must not have side effects
+// outside the transaction. Every attempt is made with ctx, which is also passed
+// to fn, so the retries stop once ctx is done. The Options are applied to the
+// retries, a classifier passed using riprovare.RetryIf replaces IsTransient.
+//
+// A nil Context, TxBeginner, RetryPolicy or function will cause a panic.
+func TxWithRetry(ctx context.Context, db TxBeginner, policy riprovare.RetryPolicy, fn func(ctx context.Context, tx *sql.Tx) error, opts ...riprovare.Option) error {
+	if db == nil {
+		panic(fmt.Errorf("illegal use of api: cannot operate on nil TxBeginner"))
+	}
+	if fn == nil {
+		panic(fmt.Errorf("illegal use of api: cannot invoke nil function"))
+	}
+	opts = append([]riprovare.Option{riprovare.RetryIf(IsTransient)}, opts...)
+	return riprovare.RetryCtx(ctx, policy, func(ctx context.Context) error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(ctx, tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}, opts...)
+}
@@ -0,0 +1,225 @@
+package riprovaresql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jkratz55/riprovare"
+	"github.com/stretchr/testify/assert"
+)
+
+type stateError string
+
+func (s stateError) Error() string {
+	return "sql state " + string(s)
+}
+
+func (s stateError) SQLState() string {
+	return string(s)
+}
+
+// fakeDriver fails executing statements and committing transactions with the
+// errors of a script, one error per call.
+type fakeDriver struct {
+	mu        sync.Mutex
+	script    []error
+	calls     int
+	commits   int
+	rollbacks int
+}
+
+func (d *fakeDriver) next() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls++
+	if len(d.script) == 0 {
+		return nil
+	}
+	err := d.script[0]
+	d.script = d.script[1:]
+	return err
+}
+
+func (d *fakeDriver) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+func (d *fakeDriver) Driver() driver.Driver {
+	return d
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return &fakeTx{d: c.d}, nil
+}
+
+func (c *fakeConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	if err := c.d.next(); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	if err := c.d.next(); err != nil {
+		return nil, err
+	}
+	return fakeRows{}, nil
+}
+
+type fakeTx struct {
+	d *fakeDriver
+}
+
+func (t *fakeTx) Commit() error {
+	t.d.mu.Lock()
+	t.d.commits++
+	t.d.mu.Unlock()
+	return nil
+}
+
+func (t *fakeTx) Rollback() error {
+	t.d.mu.Lock()
+	t.d.rollbacks++
+	t.d.mu.Unlock()
+	return nil
+}
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string {
+	return []string{"id"}
+}
+
+func (fakeRows) Close() error {
+	return nil
+}
+
+func (fakeRows) Next([]driver.Value) error {
+	return io.EOF
+}
+
+func newDB(t *testing.T, script ...error) (*sql.DB, *fakeDriver) {
+	d := &fakeDriver{script: script}
+	db := sql.OpenDB(d)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db, d
+}
+
+func newPolicy() riprovare.RetryPolicy {
+	return riprovare.FixedRetryPolicy(3, time.Millisecond)
+}
+
+func TestIsTransient(t *testing.T) {
+	assert.True(t, IsTransient(driver.ErrBadConn))
+	assert.True(t, IsTransient(fmt.Errorf("exec: %w", stateError("40001"))))
+	assert.True(t, IsTransient(stateError("40P01")))
+	assert.False(t, IsTransient(stateError("23505")))
+	assert.False(t, IsTransient(sql.ErrNoRows))
+	assert.False(t, IsTransient(nil))
+}
+
+func TestExecWithRetry(t *testing.T) {
+	db, d := newDB(t, stateError("40001"), stateError("40P01"))
+	res, err := ExecWithRetry(context.Background(), db, newPolicy(), "UPDATE accounts SET balance = ?", []any{0})
+	assert.NoError(t, err)
+	affected, _ := res.RowsAffected()
+	assert.Equal(t, int64(1), affected)
+	assert.Equal(t, 3, d.calls)
+
+	db, d = newDB(t, stateError("23505"))
+	_, err = ExecWithRetry(context.Background(), db, newPolicy(), "INSERT INTO accounts VALUES (1)", nil)
+	var abandoned riprovare.AbandonedError
+	assert.ErrorAs(t, err, &abandoned)
+	assert.Equal(t, 1, d.calls)
+
+	// A classifier passed as an Option replaces IsTransient
+	db, d = newDB(t, stateError("23505"))
+	_, err = ExecWithRetry(context.Background(), db, newPolicy(), "INSERT INTO accounts VALUES (1)", nil, riprovare.RetryIf(func(error) bool {
+		return true
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, d.calls)
+}
+
+func TestQueryWithRetry(t *testing.T) {
+	db, d := newDB(t, stateError("40001"))
+	rows, err := QueryWithRetry(context.Background(), db, newPolicy(), "SELECT id FROM accounts WHERE balance > ?", []any{0})
+	assert.NoError(t, err)
+	assert.False(t, rows.Next())
+	assert.NoError(t, rows.Close())
+	assert.Equal(t, 2, d.calls)
+
+	db, d = newDB(t, stateError("40001"), stateError("40001"), stateError("40001"))
+	var hooked []error
+	_, err = QueryWithRetry(context.Background(), db, newPolicy(), "SELECT id FROM accounts", nil, riprovare.ErrorHook(func(err error) {
+		hooked = append(hooked, err)
+	}))
+	assert.ErrorIs(t, err, riprovare.ErrRetriesExhausted)
+	assert.Equal(t, 3, d.calls)
+	assert.Len(t, hooked, 3)
+}
+
+func TestTxWithRetry(t *testing.T) {
+	db, d := newDB(t, stateError("40001"))
+	runs := 0
+	err := TxWithRetry(context.Background(), db, newPolicy(), func(ctx context.Context, tx *sql.Tx) error {
+		runs++
+		_, err := tx.ExecContext(ctx, "UPDATE accounts SET balance = 0")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, runs)
+	assert.Equal(t, 1, d.rollbacks)
+	assert.Equal(t, 1, d.commits)
+
+	db, d = newDB(t)
+	invalid := errors.New("invalid balance")
+	runs = 0
+	err = TxWithRetry(context.Background(), db, newPolicy(), func(ctx context.Context, tx *sql.Tx) error {
+		runs++
+		return invalid
+	})
+	assert.ErrorIs(t, err, invalid)
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, 1, d.rollbacks)
+	assert.Equal(t, 0, d.commits)
+
+	runs = 0
+	err = TxWithRetry(context.Background(), db, newPolicy(), func(ctx context.Context, tx *sql.Tx) error {
+		runs++
+		return invalid
+	}, riprovare.RetryIf(func(err error) bool {
+		return errors.Is(err, invalid)
+	}))
+	assert.ErrorIs(t, err, riprovare.ErrRetriesExhausted)
+	assert.Equal(t, 3, runs)
+
+	assert.Panics(t, func() {
+		_ = TxWithRetry(context.Background(), db, newPolicy(), nil)
+	})
+}